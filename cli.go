@@ -1,26 +1,162 @@
 package cli
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
 	"github.com/alexrsagen/termbox-go"
+	"golang.org/x/text/unicode/norm"
 )
 
 // ErrNotRunning is returned when a CLI is not running
 var ErrNotRunning = errors.New("a CLI is not running")
 
+// ErrNotExecuted is returned when a command line did not execute a command
+var ErrNotExecuted = errors.New("command not executed")
+
+// ErrAlreadyRunning is returned when a CLI is already running
+var ErrAlreadyRunning = errors.New("a CLI is already running")
+
+var errCommandNotFound = errors.New("command not found")
+var errInvalidArguments = errors.New("invalid arguments")
+
 type pos struct {
 	x, y int
 }
 
+// mu guards the CLI state below and drawing to the terminal. A running CLI
+// holds it, except while waiting for events and while calling commands and
+// user callbacks.
+var mu sync.RWMutex
+
+// unlocked calls fn with mu released, and locks mu again once fn returns or
+// panics. The caller must hold mu.
+func unlocked(fn func()) {
+	mu.Unlock()
+	defer mu.Lock()
+	fn()
+}
+
 var closed = true
+var suspended bool
+var suspendPos pos
 var prefix = "# "
+var prefixArgs []func() interface{}
+var indicator PromptIndicator
+var inputMode InputMode
+var viNormalMode, viPendingDelete bool
+var wordSeparators = []rune{' '}
+var completionCaseSensitive = true
+var abbreviationExpansion = true
+var fieldSeparator = ' '
 var curPos, termSize pos
 var list CommandList
+var hist history
+var onResize []func(width, height int)
+var highlighter func(input string) string
+var lineEnding = LineEndingLF
+var inputValidator func(input string) error
+var inputEchoDelay time.Duration
+var validateTimer *time.Timer
+var statusRow = -1
+var pasteHandler func(text string) string
+var pendingEvents []termbox.Event
+var pasteLookahead bool
+var onCommandSuccess func(path, args []string)
+var mouseEnabled bool
+var listingRows map[int]string
+var outputMode = termbox.OutputNormal
+var helpTopics = map[string]string{}
+var macros = map[string]string{}
+var outputPageSize, pageLines int
+var pagingOutput, pageQuit bool
+var submodeDepth int
+var exitSubmode bool
+var onReload []func(old, new CommandList)
+var auditWriter io.Writer
+var auditMu sync.Mutex
+var onPanic func(path []string, v interface{}) error
+var onStart []func()
+var autoTitle func() string
+var bellEnabled, visualBell bool
+var bellOnError = true
+var beepFunc func()
+var continuation []string
+var continuationPrompt = "> "
+var continuationColor = termbox.ColorYellow
+var outputRateLimit int
+var outputTokens float64
+var outputRefilled time.Time
+var outputTruncated bool
+var doubleClickInterval = 500 * time.Millisecond
+var lastClick time.Time
+var lastClickPos pos
+var selection [2]int
+var clipboard Clipboard
+var normForm = norm.NFC
+var onAutocomplete func(original, completed string)
+var onEnter func(input string) bool
+var onPrefixClick func()
+var inputGutter func() string
+var onTabNoMatch func(input string)
+var onOutput func(text string)
+var outputWriter io.Writer = os.Stdout
+var clearOnExec = true
+var confirmOnExit bool
+var confirmOnExitPrompt string
+var exitConfirmed bool
+var outputPos = pos{0, 1}
+var prefixEnd pos
+var inputFilter func(r rune) bool
+var tabSize = 4
+var descriptionColumnWidth int
+var completionPrefix string
+var completionDescriptions = true
+var listingCompletions bool
+var descriptionAlign = AlignLeft
+var commandSorter func(names []string) []string
+var longCommandThreshold time.Duration
+var onLongCommand func(path []string, d time.Duration)
+var autoComplete = AutoCompleteMode{TriggerOnTab: true}
+var completeTimer *time.Timer
+var completeDue bool
+var onInputChange func(old, new string, cursor int)
+var persistentFlags *flag.FlagSet
+var onTabCycle func(completions []string, index int) string
+var contextualHelp bool
+var pageUpDownInHistory bool
+var editDistance = levenshtein
+var tabCorrection bool
+
+func clearLine(y int) {
+	for x := 0; x <= termSize.x; x++ {
+		termbox.SetCell(x, y, ' ', termbox.ColorWhite, termbox.ColorDefault)
+	}
+}
+
+// clearInputArea clears input drawn from startPos up to curPos. Input filling
+// a single row by itself is cleared with clearLine, while input sharing its
+// first row with a prompt prefix or field name is cleared from startPos, so
+// the prefix is kept.
+func clearInputArea(startPos pos) {
+	if startPos.x == 0 && startPos.y == curPos.y {
+		clearLine(curPos.y)
+		return
+	}
+	clearArea(startPos, curPos)
+}
 
 func clearArea(startPos, endPos pos) {
 	if endPos.y-startPos.y < 0 {
@@ -43,9 +179,7 @@ func clearArea(startPos, endPos pos) {
 			}
 		} else {
 			if endPos.y-y > 0 {
-				for x := 0; x <= termSize.x; x++ {
-					termbox.SetCell(x, y, ' ', termbox.ColorWhite, termbox.ColorDefault)
-				}
+				clearLine(y)
 			} else {
 				for x := 0; x <= endPos.x; x++ {
 					termbox.SetCell(x, y, ' ', termbox.ColorWhite, termbox.ColorDefault)
@@ -55,11 +189,153 @@ func clearArea(startPos, endPos pos) {
 	}
 }
 
+// clearScreen clears the terminal, along with any clickable command listing
+func clearScreen() {
+	termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
+	listingRows = nil
+	outputPos = pos{0, 1}
+}
+
+// clearInput clears the input area before the prompt is redrawn. The whole
+// terminal is cleared, unless output is kept using SetClearOnExec.
+func clearInput() {
+	if statusRow > curPos.y {
+		clearLine(statusRow)
+	}
+	statusRow = -1
+	if clearOnExec {
+		clearScreen()
+		return
+	}
+	for y := 0; y <= curPos.y; y++ {
+		clearLine(y)
+	}
+}
+
+// outputStart returns the position where command output starts, which is
+// after previous output if output is kept using SetClearOnExec
+func outputStart() pos {
+	if clearOnExec {
+		return pos{0, 1}
+	}
+	return outputPos
+}
+
+// endOutput stores the position after command output, so that the next
+// command output is appended to it if output is kept using SetClearOnExec
+func endOutput() {
+	if clearOnExec {
+		return
+	}
+	if curPos.x > 0 {
+		curPos.x = 0
+		curPos.y++
+		scrollOverflow()
+	}
+	outputPos = curPos
+
+	// Remove output scrolled into the prompt row
+	clearLine(0)
+}
+
+// scrollOverflow scrolls the terminal contents up until curPos is within
+// the terminal area
+func scrollOverflow() {
+	for termSize.y > 0 && curPos.y >= termSize.y {
+		w, h := termbox.Size()
+		cells := termbox.CellBuffer()
+		for y := 1; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := cells[y*w+x]
+				termbox.SetCell(x, y-1, c.Ch, c.Fg, c.Bg)
+			}
+		}
+		clearLine(h - 1)
+		curPos.y--
+
+		// Move clickable command listing along with the terminal contents
+		rows := map[int]string{}
+		for y, name := range listingRows {
+			if y > 0 {
+				rows[y-1] = name
+			}
+		}
+		listingRows = rows
+	}
+}
+
+// parseSGR applies the parameters of an ANSI SGR escape sequence to the
+// given foreground and background attributes
+func parseSGR(params string, fg, bg termbox.Attribute) (termbox.Attribute, termbox.Attribute) {
+	const attrs = termbox.AttrBold | termbox.AttrUnderline | termbox.AttrReverse
+	for _, param := range strings.Split(params, ";") {
+		n, err := strconv.Atoi(param)
+		if err != nil && param != "" {
+			continue
+		}
+		switch {
+		case n == 0:
+			fg, bg = termbox.ColorWhite, termbox.ColorDefault
+		case n == 1:
+			fg |= termbox.AttrBold
+		case n == 4:
+			fg |= termbox.AttrUnderline
+		case n == 7:
+			fg |= termbox.AttrReverse
+		case n == 22:
+			fg &^= termbox.AttrBold
+		case n == 24:
+			fg &^= termbox.AttrUnderline
+		case n == 27:
+			fg &^= termbox.AttrReverse
+		case n >= 30 && n <= 37:
+			fg = fg&attrs | termbox.Attribute(n-30+1)
+		case n == 39:
+			fg = fg&attrs | termbox.ColorWhite
+		case n >= 40 && n <= 47:
+			bg = termbox.Attribute(n - 40 + 1)
+		case n == 49:
+			bg = termbox.ColorDefault
+		case n >= 90 && n <= 97:
+			fg = fg&attrs | termbox.Attribute(n-90+1) | termbox.AttrBold
+		}
+	}
+	return fg, bg
+}
+
 func drawText(cursor int, line string) {
+	drawTextAttr(cursor, line, termbox.ColorWhite, termbox.ColorDefault)
+}
+
+// drawTextAttr draws text like drawText, starting with the given attributes
+func drawTextAttr(cursor int, line string, fg, bg termbox.Attribute) {
 	i := 0
+	var seq []rune
+	inSeq := false
 
 	// Draw line contents
 	for _, r := range line {
+		// Parse ANSI escape sequences, which are not drawn
+		if inSeq {
+			seq = append(seq, r)
+			if len(seq) == 1 && r != '[' {
+				// Not a control sequence, ignore it
+				inSeq = false
+			} else if len(seq) > 1 && r >= 0x40 && r <= 0x7e {
+				// Final byte of control sequence
+				if r == 'm' {
+					fg, bg = parseSGR(string(seq[1:len(seq)-1]), fg, bg)
+				}
+				inSeq = false
+			}
+			continue
+		}
+		if r == '\x1b' {
+			seq = seq[:0]
+			inSeq = true
+			continue
+		}
+
 		// Set cursor position
 		if i == cursor {
 			termbox.SetCursor(curPos.x, curPos.y)
@@ -68,14 +344,19 @@ func drawText(cursor int, line string) {
 		// Set cell contents
 		switch r {
 		case '\r':
+			// Clear remainder of row before overwriting it
+			clearArea(curPos, pos{termSize.x, curPos.y})
 			curPos.x = 0
 			continue
 		case '\n':
 			curPos.x = 0
 			curPos.y++
+			scrollOverflow()
+			// Count line breaks in input, so the cursor can be placed after them
+			i++
 			continue
 		default:
-			termbox.SetCell(curPos.x, curPos.y, r, termbox.ColorWhite, termbox.ColorDefault)
+			termbox.SetCell(curPos.x, curPos.y, r, fg, bg)
 		}
 
 		// Move cell
@@ -83,8 +364,8 @@ func drawText(cursor int, line string) {
 		if curPos.x >= termSize.x {
 			curPos.x = 0
 			curPos.y++
+			scrollOverflow()
 		}
-		// XXX: handle curPos.y >= termSize.y
 
 		// Increment cell counter
 		i++
@@ -148,6 +429,20 @@ func parseArgs(args []string) []string {
 				} else {
 					inQuote = !inQuote
 				}
+			case 'n':
+				if isEscaped {
+					*arg += "\n"
+					isEscaped = false
+				} else {
+					*arg += "n"
+				}
+			case 't':
+				if isEscaped {
+					*arg += "\t"
+					isEscaped = false
+				} else {
+					*arg += "t"
+				}
 			default:
 				*arg += string(r)
 				isEscaped = false
@@ -158,374 +453,3187 @@ func parseArgs(args []string) []string {
 	return newArgs
 }
 
-// Printf outputs the formatted string to the active CLI
-func Printf(format string, a ...interface{}) {
-	if closed {
-		fmt.Printf(format, a...)
-	} else {
-		drawText(-1, fmt.Sprintf(format, a...))
-	}
+// Line endings used by Printf and Println when a CLI is not running
+const (
+	LineEndingLF   = "\n"
+	LineEndingCRLF = "\r\n"
+)
+
+// SetLineEnding sets the line ending written by Printf and Println when a CLI
+// is not running. Output drawn in a running CLI is not affected.
+func SetLineEnding(le string) {
+	mu.Lock()
+	defer mu.Unlock()
+	lineEnding = le
 }
 
-// Println outputs the operands to the active CLI
-func Println(a ...interface{}) {
-	if closed {
-		fmt.Println(a...)
-	} else {
-		drawText(-1, fmt.Sprintln(a...))
+func withLineEnding(s string) string {
+	if lineEnding == LineEndingLF {
+		return s
 	}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\n", lineEnding, -1)
 }
 
-// Exec attempts to execute a single command, and returns true if the command executed
-func Exec(path []string) bool {
-	items, args, showList := list.resolvePath(path)
-	if items == nil {
-		// Do nothing
-	} else if len(items) == 0 {
-		// Print command not found message
-		Println("Command not found")
+func printText(s string) {
+	if onOutput != nil {
+		onOutput(s)
+	}
+	if closed || suspended {
+		io.WriteString(outputWriter, withLineEnding(s))
+	} else if outputPageSize <= 0 || !pagingOutput {
+		drawText(-1, s)
 	} else {
-		if len(items) == 1 && !showList {
-			// Execute item handler
-			for name, item := range items {
-				if item.Handler != nil {
-					args = parseArgs(args)
-					if args != nil && len(args) == len(item.Arguments) || len(item.Arguments) == 1 && item.Arguments[0] == "*" {
-						item.Handler(args)
-						return true
-					}
-
-					// Print usage message
-					Printf("Usage: %s", name)
-					for _, arg := range item.Arguments {
-						Printf(" <%s>", arg)
-					}
-					Printf("\n")
-				}
+		// Draw output line by line, pausing every outputPageSize lines
+		for s != "" && !pageQuit {
+			i := strings.IndexByte(s, '\n')
+			if i < 0 {
+				drawText(-1, s)
 				break
 			}
-		} else {
-			// Get item keys
-			var names []string
-			for name := range items {
-				names = append(names, name)
+			drawText(-1, s[:i+1])
+			s = s[i+1:]
+			pageLines++
+			if pageLines >= outputPageSize {
+				pageLines = 0
+				waitMore()
 			}
+		}
+	}
+}
 
-			// Sort item keys alphabetically
-			sort.Strings(names)
+// SetOutputWriter sets the writer used for output while no CLI is running or
+// while it is suspended, such as a bytes.Buffer in tests. Output of a running
+// CLI is drawn to the terminal as before, while escape sequences for the
+// terminal, such as the bell and window title, are always written to w. Pass
+// nil to write to os.Stdout (default).
+func SetOutputWriter(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if w == nil {
+		w = os.Stdout
+	}
+	outputWriter = w
+}
 
-			// List sorted items
-			maxNameLen := 0
-			for _, name := range names {
-				if len(name) > maxNameLen {
-					maxNameLen = len(name)
-				}
-			}
-			maxNameLen += 4
+// SetClearOnExec sets whether the terminal is cleared each time a command is
+// entered. If disabled, command output is appended below previous output.
+// Defaults to true.
+func SetClearOnExec(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	clearOnExec = enabled
+}
 
-			for _, name := range names {
-				if items[name].Handler != nil {
-					Printf(strings.Repeat(" ", maxNameLen)+"%s\r%s\n", items[name].Description, name)
-				}
+// SetOnOutput sets a function to be called with all text printed by the CLI,
+// including the output of Printf and Println and command listings, before it
+// is written to the terminal. The function is called while the CLI is locked,
+// so it must not call functions of this package. Pass nil to disable it.
+func SetOnOutput(fn func(text string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onOutput = fn
+}
+
+// SetOutputPageSize sets the number of lines of command output shown before
+// pausing until a key is pressed. Pass 0 to disable pagination.
+func SetOutputPageSize(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	outputPageSize = n
+}
+
+// waitMore shows a "-- More --" prompt and waits until the user continues
+// or quits, in which case the rest of the command output is discarded
+func waitMore() {
+	drawText(-1, "\x1b[7m-- More -- (press Enter to continue, q to quit)\x1b[0m")
+	for waiting := true; waiting; {
+		switch tev := pollEvent(); tev.Type {
+		case termbox.EventKey:
+			switch {
+			case tev.Key == termbox.KeyEnter, tev.Key == termbox.KeySpace:
+				waiting = false
+			case tev.Key == termbox.KeyCtrlC, tev.Ch == 'q':
+				pageQuit = true
+				waiting = false
 			}
+		case termbox.EventResize:
+			termSize.x = tev.Width
+			termSize.y = tev.Height
+		case termbox.EventError:
+			// Leave error to be handled by Run
+			pendingEvents = append(pendingEvents, tev)
+			pageQuit = true
+			waiting = false
 		}
 	}
 
-	return false
+	// Remove prompt
+	clearLine(curPos.y)
+	curPos.x = 0
+	termbox.Flush()
 }
 
-// SetPrefix sets the CLI input prefix string
-func SetPrefix(s string) {
-	prefix = s
+// suspendPaging disables output pagination until the returned function is
+// called
+func suspendPaging() func() {
+	paging := pagingOutput
+	pagingOutput = false
+	return func() {
+		pagingOutput = paging
+		pageLines = 0
+	}
 }
 
-// SetList sets the CLI command list
-func SetList(l CommandList) {
-	list = l
+// continuesLine returns whether line ends with a backslash which is not
+// itself escaped by another backslash
+func continuesLine(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, "\\"))
+	return n%2 == 1
 }
 
-type inputEvent struct {
-	Type   termbox.EventType
-	Input  string
-	Key    termbox.Key
-	Cursor int
-	Error  error
+// execPrompt executes a command line entered at the prompt, paginating its
+// output. The caller must hold mu, which is released while executing.
+func execPrompt(line string) error {
+	cancelValidation()
+	cancelCompletion()
+	pagingOutput = true
+	pageLines = 0
+	pageQuit = false
+	var err error
+	unlocked(func() {
+		err = ExecString(line)
+	})
+	pagingOutput = false
+	return err
 }
 
-func getInput(startPos pos, cursor int, input string, mask rune) (ev inputEvent) {
-	if closed {
-		ev.Type = termbox.EventError
-		ev.Error = ErrNotRunning
+// Printf outputs the formatted string to the active CLI. It is safe to call
+// from any goroutine.
+func Printf(format string, a ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	printLimited(fmt.Sprintf(format, a...))
+}
+
+// Println outputs the operands to the active CLI. It is safe to call from any
+// goroutine.
+func Println(a ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	printLimited(fmt.Sprintln(a...))
+}
+
+// SetOutputRateLimit sets the maximum number of lines per second output by
+// Printf and Println. Excess lines are dropped, and replaced by an
+// "[output truncated]" message. Pass 0 to disable the limit.
+func SetOutputRateLimit(linesPerSecond int) {
+	mu.Lock()
+	defer mu.Unlock()
+	outputRateLimit = linesPerSecond
+	outputTokens = float64(linesPerSecond)
+	outputRefilled = time.Now()
+	outputTruncated = false
+}
+
+// printLimited prints s if allowed by the output rate limit
+func printLimited(s string) {
+	if outputRateLimit <= 0 {
+		printText(s)
 		return
 	}
 
-	ev.Input = input
-	ev.Cursor = cursor
+	// Refill token bucket
+	now := time.Now()
+	outputTokens += now.Sub(outputRefilled).Seconds() * float64(outputRateLimit)
+	if outputTokens > float64(outputRateLimit) {
+		outputTokens = float64(outputRateLimit)
+	}
+	outputRefilled = now
 
-	switch tev := termbox.PollEvent(); tev.Type {
-	case termbox.EventKey:
-		ev.Type = termbox.EventKey
-		ev.Key = tev.Key
+	// Take a token for each line, dropping s if there are not enough tokens
+	lines := float64(strings.Count(s, "\n"))
+	if lines == 0 {
+		lines = 1
+	}
+	if outputTokens < lines {
+		if !outputTruncated {
+			outputTruncated = true
+			printText("[output truncated]\n")
+		}
+		return
+	}
+	outputTokens -= lines
+	outputTruncated = false
+	printText(s)
+}
 
-		// Handle keypress
-		switch tev.Key {
-		case termbox.KeyTab, termbox.KeyEnd:
-			// Move cursor pos to end
-			ev.Cursor = utf8.RuneCountInString(ev.Input)
-			// Redraw input area
-			curPos = startPos
-			if mask != 0 {
-				drawText(ev.Cursor, strings.Repeat(string(mask), utf8.RuneCountInString(ev.Input)))
-			} else {
-				drawText(ev.Cursor, ev.Input)
-			}
+func printList(items CommandList) {
+	mu.Lock()
+	defer mu.Unlock()
 
-		case termbox.KeyHome:
-			// Move cursor pos to start
-			ev.Cursor = 0
-			// Redraw input area
-			curPos = startPos
-			if mask != 0 {
-				drawText(ev.Cursor, strings.Repeat(string(mask), utf8.RuneCountInString(ev.Input)))
-			} else {
-				drawText(ev.Cursor, ev.Input)
-			}
+	// Make listed commands clickable
+	if !closed && !suspended {
+		listingRows = map[int]string{}
+	}
 
-		case termbox.KeyArrowLeft:
-			// Move cursor pos back
-			if ev.Cursor > 0 {
-				ev.Cursor--
-				// Redraw input area
-				curPos = startPos
-				if mask != 0 {
-					drawText(ev.Cursor, strings.Repeat(string(mask), utf8.RuneCountInString(ev.Input)))
-				} else {
-					drawText(ev.Cursor, ev.Input)
-				}
-			}
+	// Get item keys, grouped by category
+	categories := map[string][]string{}
+	for name, item := range items {
+		if item.hasHandler() {
+			categories[item.Category] = append(categories[item.Category], name)
+		}
+	}
 
-		case termbox.KeyArrowRight:
-			// Move cursor pos fwd
-			if ev.Cursor < utf8.RuneCountInString(ev.Input) {
-				ev.Cursor++
-				// Redraw input area
-				curPos = startPos
-				if mask != 0 {
-					drawText(ev.Cursor, strings.Repeat(string(mask), utf8.RuneCountInString(ev.Input)))
-				} else {
-					drawText(ev.Cursor, ev.Input)
-				}
-			}
+	// Sort category names alphabetically, uncategorized items last
+	var categoryNames []string
+	for category := range categories {
+		if category != "" {
+			categoryNames = append(categoryNames, category)
+		}
+	}
+	sort.Strings(categoryNames)
+	if _, ok := categories[""]; ok {
+		categoryNames = append(categoryNames, "")
+	}
 
-		case termbox.KeyDelete:
-			cells := utf8.RuneCountInString(ev.Input)
-			if ev.Input != "" && ev.Cursor < cells {
-				// Remove character at cursor pos
-				pos := bytePos(ev.Cursor, ev.Input)
-				width := bytePos(ev.Cursor+1, ev.Input) - pos
-				ev.Input = ev.Input[:pos] + ev.Input[pos+width:]
-				// Redraw input area
-				clearArea(startPos, curPos)
-				curPos = startPos
-				if mask != 0 {
-					drawText(ev.Cursor, strings.Repeat(string(mask), utf8.RuneCountInString(ev.Input)))
-				} else {
-					drawText(ev.Cursor, ev.Input)
-				}
+	// Get max item name length
+	maxNameLen := descriptionColumnWidth
+	if maxNameLen <= 0 {
+		for name := range items {
+			if len(completionPrefix+name) > maxNameLen {
+				maxNameLen = len(completionPrefix + name)
 			}
+		}
+	}
+	nameWidth := maxNameLen
+	maxNameLen += tabSize
 
-		case termbox.KeyBackspace:
-			if ev.Input != "" && ev.Cursor > 0 {
-				// Remove character before cursor pos
-				pos := bytePos(ev.Cursor, ev.Input)
-				width := pos - bytePos(ev.Cursor-1, ev.Input)
-				ev.Input = ev.Input[:pos-width] + ev.Input[pos:]
-				// Move cursor pos back
-				ev.Cursor--
-				// Redraw input area
-				clearArea(startPos, curPos)
-				curPos = startPos
-				if mask != 0 {
-					drawText(ev.Cursor, strings.Repeat(string(mask), utf8.RuneCountInString(ev.Input)))
-				} else {
-					drawText(ev.Cursor, ev.Input)
-				}
-			}
+	for i, category := range categoryNames {
+		names := categories[category]
 
-		case 0, termbox.KeySpace, termbox.KeyCtrl3, termbox.KeyCtrl4, termbox.KeyCtrl5, termbox.KeyCtrl6, termbox.KeyCtrl7, termbox.KeyCtrl8:
-			// Weird Ctrl+C bug on Windows
-			if tev.Ch == 0x3 {
-				ev.Key = termbox.KeyCtrlC
-				return
-			}
+		// Sort item keys
+		names = sortNames(names)
 
-			// Insert character at cursor position in current history entry
-			pos := bytePos(ev.Cursor, ev.Input)
-			ev.Input = ev.Input[:pos] + string(tev.Ch) + ev.Input[pos:]
-			// Move cursor pos fwd
-			ev.Cursor++
-			// Redraw input area
-			curPos = startPos
-			if mask != 0 {
-				drawText(ev.Cursor, strings.Repeat(string(mask), utf8.RuneCountInString(ev.Input)))
+		// Print category header, unless no items are categorized
+		if len(categoryNames) > 1 || category != "" {
+			if i > 0 {
+				printText("\n")
+			}
+			if category == "" {
+				printText("Other:\n")
 			} else {
-				drawText(ev.Cursor, ev.Input)
+				printText(category + ":\n")
 			}
 		}
 
-	case termbox.EventResize:
-		// Store terminal size
-		termSize.x = tev.Width
-		termSize.y = tev.Height
-
-	case termbox.EventError:
-		// Return error
-		ev.Type = termbox.EventError
-		ev.Error = tev.Err
+		// List sorted items
+		for _, name := range names {
+			if listingRows != nil {
+				listingRows[curPos.y] = name
+			}
+			if listingCompletions && !completionDescriptions {
+				printText(truncateName(completionPrefix+name, nameWidth) + "\n")
+				continue
+			}
+			printText(strings.Repeat(" ", maxNameLen) + items[name].Description + "\r" + alignName(truncateName(completionPrefix+name, nameWidth), nameWidth) + "\n")
+		}
 	}
-
-	return
 }
 
-// Close signals for the CLI to exit on next event
-func Close() {
-	closed = true
+// Exec attempts to execute a single command, and returns true if the command executed
+func Exec(path []string) bool {
+	return execute(context.Background(), path) == nil
 }
 
-// Run sets up a new CLI on the process tty
-func Run() error {
-	var log history
-	var cursor int
+// execute attempts to execute a single command and logs it to the audit
+// writer
+func execute(ctx context.Context, path []string) error {
+	start := time.Now()
+
+	// Normalize input, so it matches command names regardless of how it was typed
+	mu.RLock()
+	form := normForm
+	mu.RUnlock()
+	normalized := make([]string, len(path))
+	for i, word := range path {
+		normalized[i] = form.String(word)
+	}
 
-	// Reset closed state
-	closed = false
+	cmdPath, args, err := execPath(ctx, normalized)
+	if cmdPath != nil {
+		audit(start, cmdPath, args, err)
+	}
 
-	// Initialize terminal
-	err := termbox.Init()
-	if err != nil {
-		return err
+	// Report slow command
+	mu.RLock()
+	threshold, fn := longCommandThreshold, onLongCommand
+	mu.RUnlock()
+	if d := time.Since(start); err == nil && fn != nil && threshold > 0 && d > threshold {
+		fn(cmdPath, d)
 	}
-	defer termbox.Close()
+	return err
+}
 
-	// Get initial terminal size
-	termW, termH := termbox.Size()
-	termSize.x = termW
-	termSize.y = termH
+// execPath attempts to execute a single command, and returns the path and
+// arguments of the resolved command. The returned path is nil if path is
+// empty, or if a list of commands was printed instead.
+func execPath(ctx context.Context, path []string) (cmdPath, args []string, err error) {
+	mu.RLock()
+	topic, isTopic := "", false
+	if len(path) == 2 && path[0] == "help" {
+		topic, isTopic = helpTopics[path[1]]
+	}
+	items, args, showList := list.resolvePath(path)
+	sep := string(fieldSeparator)
+	mu.RUnlock()
 
-	// Draw input area
-	curPos = pos{0, 0}
-	drawText(-1, prefix)
-	startPos := curPos
-	// Update cursor position
-	drawText(cursor, "")
+	// Print help topic
+	if isTopic {
+		Println(topic)
+		return path, nil, nil
+	}
 
-	for {
-		switch ev := getInput(startPos, cursor, log.get(), 0); ev.Type {
-		case termbox.EventKey:
-			// Clear terminal if new log entry and character was entered
-			if log.isLast() && log.get() == "" && ev.Key == 0 {
-				clearArea(curPos, termSize)
-				termbox.Flush()
+	if items == nil {
+		// Do nothing
+		return nil, nil, ErrNotExecuted
+	} else if len(items) == 0 {
+		// Print command not found message, suggesting the closest command
+		Println("Command not found")
+		if suggestion := suggestPath(path, args); suggestion != "" {
+			Printf("Did you mean \"%s\"?\n", suggestion)
+		}
+		errorBell()
+		return path, args, errCommandNotFound
+	} else if len(items) == 1 && !showList {
+		// Execute item handler
+		for name, item := range items {
+			cmdPath = strings.Split(name, sep)
+			if !item.hasHandler() {
+				break
+			}
+
+			args = parseArgs(args)
+			mu.Lock()
+			args, err = parseFlags(args)
+			mu.Unlock()
+			if err != nil {
+				Println(err)
+				errorBell()
+				return cmdPath, args, errInvalidArguments
+			}
+			if args != nil && len(args) == len(item.Arguments) || len(item.Arguments) == 1 && item.Arguments[0] == "*" {
+				if err := callHandler(ctx, item, cmdPath, args); err != nil {
+					Println(err)
+					return cmdPath, args, err
+				}
+				item.recordUsage()
+
+				mu.RLock()
+				fn := onCommandSuccess
+				mu.RUnlock()
+				if fn != nil {
+					fn(cmdPath, args)
+				}
+				return cmdPath, args, nil
+			}
+
+			// Print usage message
+			Printf("Usage: %s\n", formatUsage(name, item.Arguments))
+
+			// Print usage examples
+			if len(item.ExampleUsage) > 0 {
+				mu.RLock()
+				indent := strings.Repeat(" ", tabSize)
+				mu.RUnlock()
+				Println("Examples:")
+				for _, example := range item.ExampleUsage {
+					Printf("%s%s\n", indent, example)
+				}
+			}
+			return cmdPath, args, errInvalidArguments
+		}
+		return cmdPath, args, ErrNotExecuted
+	}
+
+	// Print list of commands, which is not a command execution
+	printList(items)
+	return nil, args, ErrNotExecuted
+}
+
+// SetPersistentFlags sets flags accepted by all commands, such as --verbose
+// or --output file. The flags are given after the command path, and are
+// removed from the arguments before they are passed to the command handler.
+// Pass nil to disable them.
+func SetPersistentFlags(flags *flag.FlagSet) {
+	mu.Lock()
+	defer mu.Unlock()
+	persistentFlags = flags
+}
+
+// GlobalFlag returns the value of the persistent flag name given to the last
+// executed command, or its default value if the flag was not given. Returns
+// an empty string if no such flag is set by SetPersistentFlags.
+func GlobalFlag(name string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if persistentFlags == nil {
+		return ""
+	}
+	if f := persistentFlags.Lookup(name); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
+
+// parseFlags sets the persistent flags given in args to their values, and
+// returns args without them. Flags not given are reset to their default
+// values. Arguments following "--" are never parsed as flags. The caller must
+// hold mu.
+func parseFlags(args []string) ([]string, error) {
+	fs := persistentFlags
+	if fs == nil || args == nil {
+		return args, nil
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			rest = append(rest, arg)
+			continue
+		}
+
+		// Accept both -name and --name, with the value inline or following
+		name := strings.TrimPrefix(arg[1:], "-")
+		value, hasValue := "", false
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value, hasValue = name[:i], name[i+1:], true
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			// Leave unknown flags to the command handler
+			rest = append(rest, arg)
+			continue
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			if !hasValue {
+				value = "true"
+			}
+		} else if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag needs an argument: -%s", name)
+			}
+			i++
+			value = args[i]
+		}
+		if err := f.Value.Set(value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for flag -%s: %v", value, name, err)
+		}
+	}
+	return rest, nil
+}
+
+// suggestPath returns the command path closest to path, where args starts
+// with the first word not matching a command, or an empty string if no
+// command is close enough
+func suggestPath(path, args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+
+	prefix := path[:len(path)-len(args)]
+	l := list
+	for _, word := range prefix {
+		item := l.lookup(word)
+		if item == nil {
+			return ""
+		}
+		l = item.List
+	}
+	name := closestName(l, args[0])
+	if name == "" {
+		return ""
+	}
+	return strings.Join(append(append([]string{}, prefix...), name), string(fieldSeparator))
+}
+
+// SetOnPanic sets a function to be called with the command path and the
+// recovered value when a command handler panics. The returned error is
+// treated as the error of the command, printed and returned by ExecString.
+// Pass nil to let panics propagate.
+func SetOnPanic(fn func(path []string, v interface{}) error) {
+	mu.Lock()
+	defer mu.Unlock()
+	onPanic = fn
+}
+
+// callHandler runs a command handler, recovering from panics if a panic
+// handler is set
+func callHandler(ctx context.Context, item *Command, path, args []string) (err error) {
+	mu.RLock()
+	fn := onPanic
+	mu.RUnlock()
+
+	if fn != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				err = handlePanic(fn, path, v)
+			}
+		}()
+	}
+	item.run(ctx, args)
+	return nil
+}
+
+// handlePanic calls the panic handler, recovering from any panic in it
+func handlePanic(fn func(path []string, v interface{}) error, path []string, v interface{}) (err error) {
+	defer func() {
+		if v2 := recover(); v2 != nil {
+			Printf("panic in panic handler: %v\n", v2)
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return fn(path, v)
+}
+
+type auditRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Path       []string  `json:"path"`
+	Args       []string  `json:"args"`
+	Success    bool      `json:"success"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error"`
+}
+
+// Audit sets a writer to which a JSON line is written for every command line
+// executed by Exec, whether or not a command executed. Command lines that
+// only list commands are not logged. Pass nil to disable audit logging.
+func Audit(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	auditWriter = w
+}
+
+// SetOnLongCommand sets a function to be called with the path of a command
+// and the time it took to execute, each time a command takes longer than
+// threshold to execute. The function is called after the command completes,
+// before the prompt is redrawn. Pass a threshold of 0 to disable it.
+func SetOnLongCommand(threshold time.Duration, fn func(path []string, d time.Duration)) {
+	mu.Lock()
+	defer mu.Unlock()
+	longCommandThreshold = threshold
+	onLongCommand = fn
+}
+
+func audit(start time.Time, path, args []string, err error) {
+	mu.RLock()
+	w := auditWriter
+	mu.RUnlock()
+	if w == nil {
+		return
+	}
+
+	rec := auditRecord{
+		Timestamp:  start,
+		Path:       path,
+		Args:       args,
+		Success:    err == nil,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	b, jerr := json.Marshal(rec)
+	if jerr != nil {
+		return
+	}
+
+	// Write each record as a single line
+	auditMu.Lock()
+	w.Write(append(b, '\n'))
+	auditMu.Unlock()
+}
+
+// RegisterHelpTopic adds a help page which is printed when entering
+// "help <name>". Help topics take precedence over commands.
+func RegisterHelpTopic(name, content string) {
+	mu.Lock()
+	defer mu.Unlock()
+	helpTopics[name] = content
+}
+
+// ListHelpTopics returns the names of all registered help topics in
+// alphabetical order
+func ListHelpTopics() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(helpTopics))
+	for name := range helpTopics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddMacro adds a macro which replaces name with expansion when it is the
+// first word of a line passed to ExecString. Macros are expanded only once,
+// so an expansion cannot refer to other macros.
+func AddMacro(name, expansion string) {
+	mu.Lock()
+	defer mu.Unlock()
+	macros[name] = expansion
+}
+
+// RemoveMacro removes a macro added by AddMacro
+func RemoveMacro(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(macros, name)
+}
+
+// ListMacros returns a copy of all macros added by AddMacro, keyed by name
+func ListMacros() map[string]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	m := make(map[string]string, len(macros))
+	for name, expansion := range macros {
+		m[name] = expansion
+	}
+	return m
+}
+
+// expandMacro replaces the first word of line with its macro expansion, if
+// any
+func expandMacro(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	word := trimmed
+	if i := strings.IndexByte(trimmed, ' '); i != -1 {
+		word = trimmed[:i]
+	}
+	if expansion, ok := macros[word]; ok {
+		return expansion + trimmed[len(word):]
+	}
+	return line
+}
+
+// SetUnicodeNormalization sets the Unicode normalization form applied to
+// input before it is executed. Defaults to norm.NFC.
+func SetUnicodeNormalization(form norm.Form) {
+	mu.Lock()
+	defer mu.Unlock()
+	normForm = form
+}
+
+// SetTabSize sets the number of spaces used for indentation in command
+// listings and usage examples. Defaults to 4.
+func SetTabSize(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	tabSize = n
+}
+
+// SetDescriptionColumnWidth sets the width of the name column in command
+// listings. Longer names are truncated. Pass 0 to fit the longest name
+// (default).
+func SetDescriptionColumnWidth(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	descriptionColumnWidth = n
+}
+
+// SetCompletionPrefix sets a string displayed before each command name in
+// command listings, such as the path of the current submode. The prefix is
+// only displayed, and is never inserted into the input.
+func SetCompletionPrefix(s string) {
+	mu.Lock()
+	defer mu.Unlock()
+	completionPrefix = s
+}
+
+// SetCompletionDescriptions sets whether command descriptions are shown next
+// to command names when listing completions with Tab (default true). Listings
+// shown by typing "?" always include descriptions.
+func SetCompletionDescriptions(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	completionDescriptions = enabled
+}
+
+// SetCommandSorter sets a function used to order command names in command
+// listings and exported documentation, such as by usage. The function
+// receives the names in no particular order and returns them in the order
+// to display. If the returned names are not the names received, they are
+// sorted alphabetically instead. The function is called while the CLI is
+// locked, so it must not call functions of this package, other than
+// CommandList.UsageStats. Pass nil to sort names alphabetically (default).
+func SetCommandSorter(fn func(names []string) []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	commandSorter = fn
+}
+
+// sortNames orders names using the command sorter, falling back to
+// alphabetical order if the sorter does not return the same names
+func sortNames(names []string) []string {
+	if commandSorter != nil {
+		if sorted := commandSorter(append([]string{}, names...)); samePermutation(names, sorted) {
+			return sorted
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// samePermutation returns whether b holds the same strings as a, in any
+// order
+func samePermutation(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int, len(a))
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		if count[s] == 0 {
+			return false
+		}
+		count[s]--
+	}
+	return true
+}
+
+// Alignment is the alignment of command names in command listings, set by
+// SetDescriptionAlign
+type Alignment int
+
+// Command name alignments
+const (
+	AlignLeft Alignment = iota
+	AlignRight
+	AlignCenter
+)
+
+// SetDescriptionAlign sets the alignment of command names within the name
+// column of command listings. Defaults to AlignLeft.
+func SetDescriptionAlign(align Alignment) {
+	mu.Lock()
+	defer mu.Unlock()
+	descriptionAlign = align
+}
+
+// alignName pads name to align it within width characters
+func alignName(name string, width int) string {
+	padding := width - utf8.RuneCountInString(name)
+	if padding <= 0 {
+		return name
+	}
+	switch descriptionAlign {
+	case AlignRight:
+		return strings.Repeat(" ", padding) + name
+	case AlignCenter:
+		return strings.Repeat(" ", padding/2) + name
+	}
+	return name
+}
+
+// truncateName shortens name to width characters, ending it with an
+// ellipsis if it was truncated
+func truncateName(name string, width int) string {
+	runes := []rune(name)
+	if len(runes) <= width || width <= 0 {
+		return name
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// SetOnAutocomplete sets a function to be called when pressing Tab completes
+// the input, with the input before and after completion
+func SetOnAutocomplete(fn func(original, completed string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onAutocomplete = fn
+}
+
+// completeLine completes the last word of the command path in line, if it
+// matches a single command. Returns line unchanged otherwise.
+func completeLine(line string) string {
+	l, last, ok := completionList(line)
+	if !ok {
+		return line
+	}
+
+	// Find the single command matching the last word
+	match := ""
+	for name := range l {
+		if hasNamePrefix(name, last) {
+			if match != "" {
+				return line
+			}
+			match = name
+		}
+	}
+	if match == "" || match == last {
+		return line
+	}
+	return replaceLastWord(line, last, match, l[match])
+}
+
+// completionList returns the command list containing the last word of the
+// command path in line, and the last word. Returns false if line does not
+// end in a command path.
+func completionList(line string) (CommandList, string, bool) {
+	words := strings.Split(strings.TrimLeft(line, " "), " ")
+	if fieldSeparator != ' ' {
+		if len(words) > 1 {
+			// Completing arguments
+			return nil, "", false
+		}
+		words = strings.Split(words[0], string(fieldSeparator))
+	}
+
+	// Find the list containing the last word
+	l := list
+	for _, word := range words[:len(words)-1] {
+		item := l.lookup(word)
+		if item == nil || len(item.List) == 0 {
+			return nil, "", false
+		}
+		l = item.List
+	}
+	return l, words[len(words)-1], true
+}
+
+// replaceLastWord replaces the last word of line with the name of item,
+// followed by a separator if more input is expected
+func replaceLastWord(line, last, name string, item *Command) string {
+	completed := line[:len(line)-len(last)] + name
+	if len(item.List) > 0 {
+		completed += string(fieldSeparator)
+	} else if len(item.Arguments) > 0 {
+		completed += " "
+	}
+	return completed
+}
+
+// SetEditDistance sets the function used to measure how different two
+// command names are, used to suggest commands when a command is not found,
+// and to correct the last command word on Tab if enabled by
+// SetTabCorrection. Commands within a distance of about a third of the
+// length of the typed word are suggested. The function is called while the
+// CLI is locked, so it must not call functions of this package. Pass nil to
+// disable suggestions. Defaults to the Levenshtein distance.
+func SetEditDistance(fn func(a, b string) int) {
+	mu.Lock()
+	defer mu.Unlock()
+	editDistance = fn
+}
+
+// SetTabCorrection sets whether pressing Tab when no command matches
+// replaces the last command word with the closest command, as measured by
+// the function set by SetEditDistance. The function set by SetOnTabNoMatch is
+// called first. Defaults to false.
+func SetTabCorrection(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	tabCorrection = enabled
+}
+
+// levenshtein returns the number of single character insertions, deletions
+// and substitutions needed to change a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// closestName returns the name of the command in l closest to word by edit
+// distance, or an empty string if no command is close enough
+func closestName(l CommandList, word string) string {
+	if editDistance == nil || word == "" {
+		return ""
+	}
+	if !completionCaseSensitive {
+		word = strings.ToLower(word)
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	best, bestDist := "", (utf8.RuneCountInString(word)+1)/3+1
+	for _, name := range sortNames(names) {
+		cmp := name
+		if !completionCaseSensitive {
+			cmp = strings.ToLower(name)
+		}
+		if d := editDistance(word, cmp); d < bestDist {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// correctLine replaces the last word of the command path in line with the
+// closest command name, if any
+func correctLine(line string) string {
+	l, last, ok := completionList(line)
+	if !ok {
+		return line
+	}
+	name := closestName(l, last)
+	if name == "" {
+		return line
+	}
+	return replaceLastWord(line, last, name, l[name])
+}
+
+// SetOnEnter sets a function to be called with the input each time Enter is
+// pressed, before the input is executed. If the function returns false, the
+// input is discarded without being executed or added to the history. Pass
+// nil to disable it.
+func SetOnEnter(fn func(input string) bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	onEnter = fn
+}
+
+// SetOnPrefixClick sets a function to be called when the input prefix is
+// clicked while mouse support is enabled. The prefix is redrawn after the
+// function returns. Pass nil to disable it.
+func SetOnPrefixClick(fn func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	onPrefixClick = fn
+}
+
+// SetOnTabNoMatch sets a function to be called with the input when Tab is
+// pressed and no command matches it, instead of printing "Command not found".
+// Pass nil to disable it.
+func SetOnTabNoMatch(fn func(input string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onTabNoMatch = fn
+}
+
+// hasMatches returns whether any command would be listed for line
+func hasMatches(line string) bool {
+	path := splitLine(expandMacro(line) + " ?")
+	for i, word := range path {
+		path[i] = normForm.String(word)
+	}
+	items, _, _ := list.resolvePath(path)
+	return len(items) > 0
+}
+
+// SetTabCompleteOnSpace sets whether pressing Space after a command word
+// completes it like Tab, and lists the commands of a submenu. Defaults to
+// false.
+func SetTabCompleteOnSpace(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	autoComplete.TriggerOnSpace = enabled
+}
+
+// AutoCompleteMode sets when command words are completed, set by
+// SetAutoComplete
+type AutoCompleteMode struct {
+	// TriggerOnTab completes the command word when pressing Tab, or lists
+	// the matching commands (default true)
+	TriggerOnTab bool
+	// TriggerOnSpace completes the command word before an inserted space,
+	// like SetTabCompleteOnSpace
+	TriggerOnSpace bool
+	// TriggerOnDelay completes the command word at the end of the input once
+	// no key has been pressed for the delay. Commands are not listed.
+	TriggerOnDelay time.Duration
+	// MinPrefixLen is the number of characters of a command word which must
+	// be typed before it is completed
+	MinPrefixLen int
+}
+
+// SetAutoComplete sets all options of when command words are completed at
+// once
+func SetAutoComplete(mode AutoCompleteMode) {
+	mu.Lock()
+	defer mu.Unlock()
+	autoComplete = mode
+	cancelCompletion()
+}
+
+// canComplete returns whether enough of the last word of line is typed for
+// it to be completed
+func canComplete(line string) bool {
+	return utf8.RuneCountInString(lastWord(line)) >= autoComplete.MinPrefixLen
+}
+
+// scheduleCompletion completes the input once no key has been pressed for
+// the completion delay, by interrupting the event loop. The caller must hold
+// mu.
+func scheduleCompletion() {
+	cancelCompletion()
+	var t *time.Timer
+	t = time.AfterFunc(autoComplete.TriggerOnDelay, func() {
+		mu.Lock()
+		if completeTimer != t || closed || suspended {
+			// Completion was cancelled
+			mu.Unlock()
+			return
+		}
+		completeTimer = nil
+		completeDue = true
+		mu.Unlock()
+		termbox.Interrupt()
+	})
+	completeTimer = t
+}
+
+// cancelCompletion cancels completion scheduled by scheduleCompletion. The
+// caller must hold mu.
+func cancelCompletion() {
+	if completeTimer != nil {
+		completeTimer.Stop()
+		completeTimer = nil
+	}
+	completeDue = false
+}
+
+// setInput replaces the current history entry with s, and redraws it with
+// the cursor at the end. The caller must hold mu and hist.mu.
+func setInput(startPos pos, s string) int {
+	hist.set(s)
+	selection = [2]int{}
+	cursor := utf8.RuneCountInString(s)
+
+	// Redraw input area
+	clearArea(startPos, curPos)
+	curPos = startPos
+	drawInput(cursor, s, 0, true)
+	return cursor
+}
+
+// setCompletion replaces the current history entry with its completion and
+// redraws the input area. The caller must hold mu and hist.mu, which are
+// released while calling the autocomplete hook.
+func setCompletion(startPos pos, line, completed string) int {
+	cursor := setInput(startPos, completed)
+	if fn := onAutocomplete; fn != nil {
+		hist.mu.Unlock()
+		unlocked(func() {
+			fn(line, completed)
+		})
+		hist.mu.Lock()
+	}
+	return cursor
+}
+
+// Completions returns the names of the commands completing the last word of
+// the command path in line, in the order set by SetCommandSorter, without
+// printing anything. If line ends with a separator, the names of all commands
+// following the command path are returned. This can be used to implement
+// completion for shells such as bash, zsh and fish.
+func Completions(line string) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return completions(line)
+}
+
+func completions(line string) []string {
+	trimmed := strings.TrimLeft(line, " ")
+	if fieldSeparator != ' ' && strings.Contains(trimmed, " ") {
+		// Completing arguments
+		return nil
+	}
+	words := splitLine(trimmed)
+	if trimmed != "" && strings.HasSuffix(trimmed, " ") {
+		words = append(words, "")
+	}
+	if len(words) == 1 && words[0] == "" {
+		names := make([]string, 0, len(list))
+		for name := range list {
+			names = append(names, name)
+		}
+		return sortNames(names)
+	}
+
+	// Keep only commands at the depth of the last word
+	possibilities, _, _ := list.resolvePath(words)
+	var names []string
+	for path := range possibilities {
+		segments := strings.Split(path, string(fieldSeparator))
+		if len(segments) != len(words) {
+			continue
+		}
+		if name := segments[len(segments)-1]; hasNamePrefix(name, words[len(words)-1]) {
+			names = append(names, name)
+		}
+	}
+	return sortNames(names)
+}
+
+// SetOnTabCycle sets a function used to cycle through completions when
+// pressing Tab repeatedly while multiple commands match, instead of listing
+// them. The function receives the completions of the last word, in the order
+// set by SetCommandSorter, and the number of times Tab was pressed before,
+// starting at 0. It returns the word to insert in place of the last word.
+// Pass nil to list matching commands (default).
+func SetOnTabCycle(fn func(completions []string, index int) string) {
+	mu.Lock()
+	defer mu.Unlock()
+	onTabCycle = fn
+}
+
+// DefaultTabCycle selects the completions in order, starting over after the
+// last completion
+func DefaultTabCycle(completions []string, index int) string {
+	return completions[index%len(completions)]
+}
+
+// lastWord returns the last word of the command path in line
+func lastWord(line string) string {
+	i := strings.LastIndexAny(line, " "+string(fieldSeparator))
+	return line[i+1:]
+}
+
+// listCommands lists the commands matching line below the prompt. The caller
+// must hold mu and hist.mu, which are released while listing.
+func listCommands(line string) {
+	// Clear terminal
+	clearInput()
+
+	if clearOnExec {
+		curPos.x = 0
+		curPos.y++
+	} else {
+		curPos = outputPos
+	}
+	hist.mu.Unlock()
+	listingCompletions = true
+	execPrompt(line + " ?")
+	listingCompletions = false
+	hist.mu.Lock()
+	endOutput()
+}
+
+// isSubmenu returns whether the command path in line names a command
+// containing other commands
+func isSubmenu(line string) bool {
+	l := list
+	var item *Command
+	for _, word := range splitLine(line) {
+		if item = l.lookup(word); item == nil {
+			return false
+		}
+		l = item.List
+	}
+	return item != nil && len(item.List) > 0
+}
+
+// SetOnCommandSuccess sets a function to be called with the full path and
+// parsed arguments of a command each time its handler has run
+func SetOnCommandSuccess(fn func(path, args []string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onCommandSuccess = fn
+}
+
+// SetFieldSeparator sets the separator between the names in a command path,
+// such as '.' for "network.interface.add". Defaults to a space.
+func SetFieldSeparator(sep rune) {
+	mu.Lock()
+	defer mu.Unlock()
+	fieldSeparator = sep
+}
+
+// splitLine splits a command line into words, splitting the command path by
+// the field separator
+func splitLine(line string) []string {
+	words := strings.Split(strings.Trim(line, " "), " ")
+	if fieldSeparator == ' ' {
+		return words
+	}
+	return append(strings.Split(words[0], string(fieldSeparator)), words[1:]...)
+}
+
+// ExecString splits a command line into words and attempts to execute it as a
+// single command. Arguments are parsed the same way as in Exec. Returns the
+// error set by the function passed to SetOnPanic if the command panicked.
+func ExecString(line string) error {
+	mu.RLock()
+	path := splitLine(expandMacro(line))
+	mu.RUnlock()
+
+	return execError(execute(context.Background(), path))
+}
+
+// execError maps errors of commands which did not execute to ErrNotExecuted,
+// and returns other errors, such as those set by the panic handler, as is
+func execError(err error) error {
+	switch err {
+	case ErrNotExecuted, errCommandNotFound, errInvalidArguments:
+		return ErrNotExecuted
+	default:
+		return err
+	}
+}
+
+// ExecWithTimeout attempts to execute a single command like Exec, but stops
+// waiting for the command after timeout has passed. The context passed to a
+// ContextHandler is cancelled on timeout, and when ExecWithTimeout returns.
+// Returns context.DeadlineExceeded if the command timed out, and otherwise
+// the same errors as ExecString.
+func ExecWithTimeout(timeout time.Duration, path []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- execute(ctx, path)
+	}()
+
+	select {
+	case err := <-done:
+		return execError(err)
+	case <-ctx.Done():
+		Println("Command timed out")
+		return context.DeadlineExceeded
+	}
+}
+
+// SetPrefix sets the CLI input prefix string
+func SetPrefix(s string) {
+	mu.Lock()
+	defer mu.Unlock()
+	prefix = s
+	prefixArgs = nil
+}
+
+// SetPrefixTemplate sets the CLI input prefix to a format string, which is
+// formatted with the return values of args each time the prefix is drawn
+func SetPrefixTemplate(template string, args ...func() interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	prefix = template
+	prefixArgs = args
+}
+
+// PromptIndicator renders a string prepended to the CLI input prefix
+type PromptIndicator interface {
+	Render() string
+}
+
+// VimIndicator is a PromptIndicator showing whether vi-style input is in
+// insert or normal mode
+type VimIndicator struct{}
+
+// Render returns "[N] " in normal mode, otherwise "[I] "
+func (VimIndicator) Render() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if viNormalMode {
+		return "[N] "
+	}
+	return "[I] "
+}
+
+// InputMode is a set of key bindings used to edit the command line input
+type InputMode int
+
+const (
+	// InputModeEmacs uses emacs-style key bindings, such as Ctrl+A, Ctrl+E
+	// and Ctrl+W
+	InputModeEmacs InputMode = iota
+	// InputModeVi uses vi-style key bindings, with a normal and an insert mode
+	InputModeVi
+)
+
+// SetInputMode sets the key bindings used to edit the command line input.
+// Defaults to InputModeEmacs. In InputModeVi, input starts in insert mode.
+func SetInputMode(mode InputMode) {
+	mu.Lock()
+	defer mu.Unlock()
+	inputMode = mode
+	viNormalMode = false
+	viPendingDelete = false
+}
+
+// SetPromptIndicator sets the PromptIndicator prepended to the CLI input
+// prefix. Pass nil to disable it.
+func SetPromptIndicator(i PromptIndicator) {
+	mu.Lock()
+	defer mu.Unlock()
+	indicator = i
+}
+
+// renderPrefix returns the prefix formatted with its template arguments and
+// prompt indicator. The caller must hold mu, which is released while calling
+// them.
+func renderPrefix() string {
+	s, args, ind := prefix, prefixArgs, indicator
+	unlocked(func() {
+		if args != nil {
+			a := make([]interface{}, len(args))
+			for i, arg := range args {
+				a[i] = arg()
+			}
+			s = fmt.Sprintf(s, a...)
+		}
+		if ind != nil {
+			s = ind.Render() + s
+		}
+	})
+	return s
+}
+
+// SetInputFilter sets a function deciding whether a typed character may be
+// inserted into the input. Characters for which it returns false are
+// discarded. Pass nil to allow all characters.
+func SetInputFilter(fn func(r rune) bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	inputFilter = fn
+}
+
+// DefaultASCIIFilter returns an input filter blocking characters outside the
+// ASCII range
+func DefaultASCIIFilter() func(r rune) bool {
+	return func(r rune) bool {
+		return r <= 127
+	}
+}
+
+// SetSyntaxHighlighter sets a function used to highlight the command line
+// input. The function receives the raw input and returns it with ANSI color
+// escape sequences added. The visible text must not be changed.
+func SetSyntaxHighlighter(fn func(input string) string) {
+	mu.Lock()
+	defer mu.Unlock()
+	highlighter = fn
+}
+
+// SetInputValidator sets a function used to validate the command line input
+// after each character is inserted or deleted. If it returns an error, the
+// error is shown below the input until the input is valid again.
+func SetInputValidator(fn func(input string) error) {
+	mu.Lock()
+	defer mu.Unlock()
+	inputValidator = fn
+}
+
+// SetInputEchoDelay sets how long to wait after the last key press before
+// validating the command line input using the function set by
+// SetInputValidator. Pass 0 to validate after each key press (default).
+func SetInputEchoDelay(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	inputEchoDelay = d
+	cancelValidation()
+}
+
+// scheduleValidation validates input once no key has been pressed for the
+// input echo delay. The caller must hold mu.
+func scheduleValidation(input string) {
+	cancelValidation()
+	var t *time.Timer
+	t = time.AfterFunc(inputEchoDelay, func() {
+		mu.RLock()
+		fn := inputValidator
+		mu.RUnlock()
+		if fn == nil {
+			return
+		}
+		err := fn(input)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if validateTimer != t || closed || suspended {
+			// Validation was cancelled
+			return
+		}
+		validateTimer = nil
+		drawStatus(err)
+	})
+	validateTimer = t
+}
+
+// cancelValidation cancels validation scheduled by scheduleValidation. The
+// caller must hold mu.
+func cancelValidation() {
+	if validateTimer != nil {
+		validateTimer.Stop()
+		validateTimer = nil
+	}
+}
+
+// drawStatus shows err on the row below the input area, replacing any
+// previous status. A nil err clears the status.
+func drawStatus(err error) {
+	if err == nil {
+		drawStatusText("", "")
+		return
+	}
+	if bellOnError && statusRow < 0 && curPos.y+1 < termSize.y {
+		bell()
+	}
+	drawStatusText(err.Error(), "\x1b[31m")
+}
+
+// drawStatusText shows text in the color set by the SGR sequence sgr on the
+// row below the input area, replacing any previous status. An empty text
+// clears the status.
+func drawStatusText(text, sgr string) {
+	if statusRow > curPos.y {
+		clearLine(statusRow)
+	}
+	statusRow = -1
+	if text == "" || curPos.y+1 >= termSize.y {
+		termbox.Flush()
+		return
+	}
+
+	// Draw status without moving the output position
+	endPos := curPos
+	statusRow = curPos.y + 1
+	curPos = pos{0, statusRow}
+	msg := []rune(text)
+	if len(msg) > termSize.x-1 {
+		msg = msg[:termSize.x-1]
+	}
+	drawText(-1, sgr+string(msg)+"\x1b[0m")
+	curPos = endPos
+}
+
+// SetContextualHelp sets whether the description of the command best
+// matching the input is shown below the input while typing. Errors returned
+// by the function set by SetInputValidator are shown instead when present.
+func SetContextualHelp(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	contextualHelp = enabled
+}
+
+// contextHint returns the description of the command best matching line,
+// preferring the shortest matching command path. The caller must hold mu.
+func contextHint(line string) string {
+	possibilities, _, _ := list.resolvePath(splitLine(line))
+	paths := make([]string, 0, len(possibilities))
+	for path := range possibilities {
+		paths = append(paths, path)
+	}
+	best := ""
+	for _, path := range sortNames(paths) {
+		if best == "" || strings.Count(path, string(fieldSeparator)) < strings.Count(best, string(fieldSeparator)) {
+			best = path
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return possibilities[best].Description
+}
+
+// SetOnResize adds a function to be called with the new terminal size
+// whenever the terminal is resized. Functions are called in the order they
+// were added, after the terminal has been redrawn.
+func SetOnResize(fn func(width, height int)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onResize = append(onResize, fn)
+}
+
+// resized calls the resize functions. The caller must hold mu, which is
+// released while the functions are called.
+func resized() {
+	fns, w, h := onResize, termSize.x, termSize.y
+	unlocked(func() {
+		for _, fn := range fns {
+			fn(w, h)
+		}
+	})
+}
+
+// SetList sets the CLI command list
+func SetList(l CommandList) {
+	mu.Lock()
+	defer mu.Unlock()
+	list = l
+}
+
+// HotReload replaces the CLI command list while the CLI is running, and then
+// calls the functions added by SetOnReloadHook. Commands which are already
+// executing complete using the old command list. Inside a submode, the
+// command list of the submode is replaced, and the list in use before the
+// submode is restored when it ends.
+func HotReload(l CommandList) {
+	mu.Lock()
+	old := list
+	list = l
+	fns := onReload
+	mu.Unlock()
+
+	for _, fn := range fns {
+		fn(old, l)
+	}
+}
+
+// SetOnReloadHook adds a function to be called with the old and new command
+// lists after HotReload has replaced the command list. Functions are called
+// in the order they were added.
+func SetOnReloadHook(fn func(old, new CommandList)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onReload = append(onReload, fn)
+}
+
+// SetCompletionCaseSensitive sets whether command names are matched case
+// sensitively when resolving and completing commands. Defaults to true.
+func SetCompletionCaseSensitive(sensitive bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	completionCaseSensitive = sensitive
+}
+
+// SetAbbreviationExpansion sets whether a word matching the start of a single
+// command name is accepted as that command when executing. If disabled, the
+// matching command is listed instead. Defaults to true.
+func SetAbbreviationExpansion(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	abbreviationExpansion = enabled
+}
+
+// SetPasteHandler enables bracketed paste, and sets a function used to
+// transform pasted text before it is inserted into the input. Line breaks
+// left in text pasted into the command line are replaced with spaces. Pass
+// nil to disable bracketed paste.
+func SetPasteHandler(fn func(text string) string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !closed && !suspended && (fn != nil) != (pasteHandler != nil) {
+		setBracketedPaste(fn != nil)
+	}
+	pasteHandler = fn
+}
+
+// writeEscape writes a terminal escape sequence to the output writer
+func writeEscape(s string) {
+	io.WriteString(outputWriter, s)
+}
+
+func setBracketedPaste(enabled bool) {
+	if enabled {
+		writeEscape("\x1b[?2004h")
+	} else {
+		writeEscape("\x1b[?2004l")
+	}
+}
+
+// pollEvent waits for the next terminal event without blocking output from
+// other goroutines. The caller must hold mu.
+func pollEvent() termbox.Event {
+	if len(pendingEvents) > 0 {
+		tev := pendingEvents[0]
+		pendingEvents = pendingEvents[1:]
+		return tev
+	}
+	var tev termbox.Event
+	unlocked(func() {
+		tev = termbox.PollEvent()
+	})
+	return tev
+}
+
+// readPaste reads a bracketed paste following an escape key event. If the
+// events do not start a paste, they are kept to be read again by pollEvent.
+func readPaste() (string, bool) {
+	const start, end = "[200~", "\x1b[201~"
+
+	// Read start marker
+	var read []termbox.Event
+	for _, ch := range start {
+		tev := pollEvent()
+		read = append(read, tev)
+		if tev.Type != termbox.EventKey || tev.Key != 0 || tev.Ch != ch {
+			pendingEvents = append(read, pendingEvents...)
+			return "", false
+		}
+	}
+
+	// Read pasted text until end marker
+	var text []rune
+	for !strings.HasSuffix(string(text), end) {
+		tev := pollEvent()
+		if tev.Type == termbox.EventError {
+			pendingEvents = append(pendingEvents, tev)
+			break
+		}
+		if tev.Type != termbox.EventKey {
+			continue
+		}
+		switch {
+		case tev.Ch != 0:
+			text = append(text, tev.Ch)
+		case tev.Key == termbox.KeySpace:
+			text = append(text, ' ')
+		case tev.Key == termbox.KeyEnter, tev.Key == termbox.KeyCtrlJ:
+			text = append(text, '\n')
+		case tev.Key == termbox.KeyTab:
+			text = append(text, '\t')
+		case tev.Key == termbox.KeyEsc:
+			text = append(text, '\x1b')
+		}
+	}
+	return strings.TrimSuffix(string(text), end), true
+}
+
+// EnableMouseSupport enables mouse input. Clicking a command in a command
+// listing executes it, and scrolling navigates the input history.
+func EnableMouseSupport() {
+	mu.Lock()
+	defer mu.Unlock()
+	mouseEnabled = true
+	if !closed && !suspended {
+		termbox.SetInputMode(termbox.InputEsc | termbox.InputMouse)
+	}
+}
+
+// DisableMouseSupport disables mouse input enabled by EnableMouseSupport
+func DisableMouseSupport() {
+	mu.Lock()
+	defer mu.Unlock()
+	mouseEnabled = false
+	if !closed && !suspended {
+		termbox.SetInputMode(termbox.InputEsc)
+	}
+}
+
+// SetTermboxOutputMode sets the termbox output mode used by the CLI, for
+// example termbox.Output256 to enable 256 colors. Defaults to
+// termbox.OutputNormal.
+func SetTermboxOutputMode(mode termbox.OutputMode) {
+	mu.Lock()
+	defer mu.Unlock()
+	outputMode = mode
+	if !closed && !suspended {
+		termbox.SetOutputMode(mode)
+	}
+}
+
+// SetWordSeparators sets the characters treated as word boundaries when
+// moving or deleting by word. Defaults to a space.
+func SetWordSeparators(chars string) {
+	mu.Lock()
+	defer mu.Unlock()
+	wordSeparators = []rune(chars)
+}
+
+func isWordSeparator(r rune) bool {
+	for _, sep := range wordSeparators {
+		if r == sep {
+			return true
+		}
+	}
+	return false
+}
+
+// wordBoundaryLeft returns the position of the start of the word before
+// cursor
+func wordBoundaryLeft(input []rune, cursor int) int {
+	i := cursor
+	for i > 0 && isWordSeparator(input[i-1]) {
+		i--
+	}
+	for i > 0 && !isWordSeparator(input[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordBoundaryRight returns the position of the start of the word after
+// cursor
+func wordBoundaryRight(input []rune, cursor int) int {
+	i := cursor
+	for i < len(input) && !isWordSeparator(input[i]) {
+		i++
+	}
+	for i < len(input) && isWordSeparator(input[i]) {
+		i++
+	}
+	return i
+}
+
+// viCommand handles a key press in vi normal mode
+func viCommand(ev *inputEvent, ch rune) (redraw, clear bool) {
+	input := []rune(ev.Input)
+	pendingDelete := viPendingDelete
+	viPendingDelete = false
+
+	switch ch {
+	case 'i':
+		// Enter insert mode
+		viNormalMode = false
+	case 'h':
+		// Move cursor pos back
+		if ev.Cursor > 0 {
+			ev.Cursor--
+			redraw = true
+		}
+	case 'l', ' ':
+		// Move cursor pos fwd
+		if ev.Cursor < len(input) {
+			ev.Cursor++
+			redraw = true
+		}
+	case 'j':
+		// Go to next history entry
+		ev.Key = termbox.KeyArrowDown
+	case 'k':
+		// Go to previous history entry
+		ev.Key = termbox.KeyArrowUp
+	case 'w':
+		// Move cursor pos to next word
+		ev.Cursor = wordBoundaryRight(input, ev.Cursor)
+		redraw = true
+	case 'b':
+		// Move cursor pos to previous word
+		ev.Cursor = wordBoundaryLeft(input, ev.Cursor)
+		redraw = true
+	case '0':
+		// Move cursor pos to start
+		ev.Cursor = 0
+		redraw = true
+	case '$':
+		// Move cursor pos to end
+		ev.Cursor = len(input)
+		redraw = true
+	case 'x':
+		// Remove character at cursor pos
+		if ev.Cursor < len(input) {
+			ev.Input = string(input[:ev.Cursor]) + string(input[ev.Cursor+1:])
+			clear = true
+		}
+	case 'd':
+		// Clear input on dd
+		if pendingDelete {
+			ev.Input = ""
+			ev.Cursor = 0
+			clear = true
+		} else {
+			viPendingDelete = true
+		}
+	}
+	return
+}
+
+type inputEvent struct {
+	Type   termbox.EventType
+	Input  string
+	Key    termbox.Key
+	Cursor int
+	Error  error
+}
+
+// SetPageUpDownInHistory sets whether pressing Page Up and Page Down moves to
+// the previous and next CLI input history entry, like the arrow keys.
+// Defaults to false.
+func SetPageUpDownInHistory(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	pageUpDownInHistory = enabled
+}
+
+// SetDoubleClickInterval sets the maximum time between two clicks on the
+// same position for them to count as a double-click. Double-clicking the
+// input selects the word under the pointer. Defaults to 500ms.
+func SetDoubleClickInterval(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	doubleClickInterval = d
+}
+
+// selectWord selects the word at position i in input, and returns the end
+// position of the word
+func selectWord(input []rune, i int) int {
+	if i >= len(input) || isWordSeparator(input[i]) {
+		return i
+	}
+	start, end := i, i
+	for start > 0 && !isWordSeparator(input[start-1]) {
+		start--
+	}
+	for end < len(input) && !isWordSeparator(input[end]) {
+		end++
+	}
+	selection = [2]int{start, end}
+	return end
+}
+
+// copyToClipboard copies text to the clipboard set by SetClipboard, or to the
+// system clipboard using an OSC 52 escape sequence if none is set
+func copyToClipboard(text string) {
+	if board := clipboard; board != nil {
+		unlocked(func() {
+			board.Write(text)
+		})
+		return
+	}
+	writeEscape("\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\x07")
+}
+
+// pasteText transforms pasted text using the paste handler, and inserts it
+// at the cursor position. Line breaks pasted into the command line are
+// replaced with spaces.
+func pasteText(ev *inputEvent, text string, prompt bool) {
+	if fn := pasteHandler; fn != nil {
+		// Transform pasted text, without blocking output from the handler
+		unlocked(func() {
+			text = fn(text)
+		})
+	}
+
+	// Keep command line input on a single line
+	if prompt {
+		text = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(text)
+	}
+
+	// Insert pasted text at cursor position
+	pos := bytePos(ev.Cursor, ev.Input)
+	ev.Input = ev.Input[:pos] + text + ev.Input[pos:]
+	// Move cursor pos fwd
+	ev.Cursor += utf8.RuneCountInString(text)
+}
+
+// SetOnInputChange sets a function to be called each time a key press changes
+// the command line input or moves the cursor, before the input is redrawn.
+// The function is called while the CLI is locked, so it must not call
+// functions of this package, such as Printf. Pass nil to disable it.
+func SetOnInputChange(fn func(old, new string, cursor int)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onInputChange = fn
+}
+
+// inputChanged calls the input change hook if ev changed the input or cursor
+func inputChanged(input string, cursor int, ev inputEvent) {
+	if onInputChange != nil && (ev.Input != input || ev.Cursor != cursor) {
+		onInputChange(input, ev.Input, ev.Cursor)
+	}
+}
+
+func drawInput(cursor int, input string, mask rune, prompt bool) {
+	if mask != 0 {
+		drawText(cursor, strings.Repeat(string(mask), utf8.RuneCountInString(input)))
+	} else if prompt && selection[0] != selection[1] {
+		// Draw selection with reversed colors, clamped to the input
+		runes := []rune(input)
+		start, end := selection[0], selection[1]
+		if end > len(runes) {
+			end = len(runes)
+		}
+		if start > end {
+			start = end
+		}
+		drawText(cursor, string(runes[:start])+"\x1b[7m"+string(runes[start:end])+"\x1b[27m"+string(runes[end:]))
+	} else if fn := highlighter; prompt && fn != nil {
+		var s string
+		p := curPos
+		unlocked(func() {
+			s = fn(input)
+		})
+		curPos = p
+		drawText(cursor, s)
+	} else if !prompt && strings.Contains(input, "\n") {
+		// Draw lines of multi-line field input below the first line, moving
+		// the cursor past the indentation
+		runes := []rune(input)
+		if cursor > len(runes) {
+			cursor = len(runes)
+		}
+		if cursor >= 0 {
+			cursor += strings.Count(string(runes[:cursor]), "\n") * curPos.x
+		}
+		drawText(cursor, indentLines(input, curPos.x))
+	} else {
+		drawText(cursor, input)
+	}
+}
+
+// indentLines indents all lines of s but the first by n spaces
+func indentLines(s string, n int) string {
+	return strings.Replace(s, "\n", "\n"+strings.Repeat(" ", n), -1)
+}
+
+func getInput(startPos pos, cursor int, input string, mask rune, prompt bool) (ev inputEvent) {
+	if closed {
+		ev.Type = termbox.EventError
+		ev.Error = ErrNotRunning
+		return
+	}
+
+	ev.Input = input
+	ev.Cursor = cursor
+	vi := prompt && inputMode == InputModeVi
+
+	// Look for a bracketed paste started by the escape key which entered vi
+	// normal mode on the previous call
+	var pasted string
+	var isPaste bool
+	if pasteLookahead {
+		pasteLookahead = false
+		if pasted, isPaste = readPaste(); isPaste {
+			// Return to insert mode
+			viNormalMode = false
+		}
+	}
+	tev := termbox.Event{Type: termbox.EventKey, Key: termbox.KeyEsc}
+	if !isPaste {
+		tev = pollEvent()
+	}
+
+	switch tev.Type {
+	case termbox.EventKey:
+		ev.Type = termbox.EventKey
+		ev.Key = tev.Key
+
+		// Handle keypress
+		var redraw, clear bool
+
+		// Copy, remove or replace selected text
+		if sel := selection; sel[0] != sel[1] {
+			selection = [2]int{}
+			runes := []rune(ev.Input)
+			redraw = true
+			switch tev.Key {
+			case termbox.KeyCtrlC:
+				// Copy selection instead of cancelling input
+				copyToClipboard(string(runes[sel[0]:sel[1]]))
+				ev.Key = 0
+				curPos = startPos
+				drawInput(ev.Cursor, ev.Input, mask, prompt)
+				return
+			case termbox.KeyBackspace, termbox.KeyDelete, termbox.KeyCtrlD:
+				// Remove selection
+				ev.Input = string(runes[:sel[0]]) + string(runes[sel[1]:])
+				ev.Cursor = sel[0]
+				if prompt {
+					inputChanged(input, cursor, ev)
+				}
+				clearInputArea(startPos)
+				curPos = startPos
+				drawInput(ev.Cursor, ev.Input, mask, prompt)
+				return
+			case 0, termbox.KeySpace:
+				// Remove selection before inserting character
+				ev.Input = string(runes[:sel[0]]) + string(runes[sel[1]:])
+				ev.Cursor = sel[0]
+				clear = true
+			}
+		}
+
+		switch tev.Key {
+		case termbox.KeyTab, termbox.KeyEnd, termbox.KeyCtrlE:
+			// Move cursor pos to end
+			ev.Cursor = utf8.RuneCountInString(ev.Input)
+			redraw = true
+
+		case termbox.KeyHome, termbox.KeyCtrlA:
+			// Move cursor pos to start
+			ev.Cursor = 0
+			redraw = true
+
+		case termbox.KeyArrowLeft:
+			// Move cursor pos back
+			if ev.Cursor > 0 {
+				ev.Cursor--
+				redraw = true
+			}
+
+		case termbox.KeyArrowRight:
+			// Move cursor pos fwd
+			if ev.Cursor < utf8.RuneCountInString(ev.Input) {
+				ev.Cursor++
+				redraw = true
+			}
+
+		case termbox.KeyCtrlD:
+			// Signal end of input if input is empty
+			if ev.Input == "" {
+				ev.Type = termbox.EventError
+				ev.Error = io.EOF
+				return
+			}
+			fallthrough
+
+		case termbox.KeyDelete:
+			cells := utf8.RuneCountInString(ev.Input)
+			if ev.Input != "" && ev.Cursor < cells {
+				// Remove character at cursor pos
+				pos := bytePos(ev.Cursor, ev.Input)
+				width := bytePos(ev.Cursor+1, ev.Input) - pos
+				ev.Input = ev.Input[:pos] + ev.Input[pos+width:]
+				clear = true
+			}
+
+		case termbox.KeyBackspace:
+			if ev.Input != "" && ev.Cursor > 0 {
+				// Remove character before cursor pos
+				pos := bytePos(ev.Cursor, ev.Input)
+				width := pos - bytePos(ev.Cursor-1, ev.Input)
+				ev.Input = ev.Input[:pos-width] + ev.Input[pos:]
+				// Move cursor pos back
+				ev.Cursor--
+				clear = true
+			}
+
+		case termbox.KeyCtrlW:
+			if ev.Cursor > 0 {
+				// Remove word before cursor pos
+				runes := []rune(ev.Input)
+				start := wordBoundaryLeft(runes, ev.Cursor)
+				ev.Input = string(runes[:start]) + string(runes[ev.Cursor:])
+				// Move cursor pos to start of word
+				ev.Cursor = start
+				clear = true
+			}
+
+		case termbox.KeyCtrlV:
+			// Paste from clipboard
+			if board := clipboard; board != nil {
+				var text string
+				var err error
+				unlocked(func() {
+					text, err = board.Read()
+				})
+				if err == nil {
+					pasteText(&ev, text, prompt)
+					redraw = true
+				}
+			}
+
+		case termbox.KeyEsc:
+			if isPaste {
+				pasteText(&ev, pasted, prompt)
+				redraw = true
+				break
+			}
+
+			// Enter vi normal mode without waiting for another key, so the mode
+			// is redrawn right away, and look for a paste on the next call
+			if vi && !viNormalMode {
+				viNormalMode = true
+				viPendingDelete = false
+				pasteLookahead = pasteHandler != nil
+				break
+			}
+
+			if pasteHandler != nil {
+				if text, ok := readPaste(); ok {
+					pasteText(&ev, text, prompt)
+					redraw = true
+					break
+				}
+			}
+
+			// Enter vi normal mode
+			if vi {
+				viNormalMode = true
+				viPendingDelete = false
+			}
+
+		case 0, termbox.KeySpace, termbox.KeyCtrl4, termbox.KeyCtrl5, termbox.KeyCtrl6, termbox.KeyCtrl7, termbox.KeyCtrl8:
+			// Weird Ctrl+C bug on Windows
+			if tev.Ch == 0x3 {
+				ev.Key = termbox.KeyCtrlC
+				return
+			}
+
+			// Handle vi normal mode command
+			if vi && viNormalMode {
+				ch := tev.Ch
+				if tev.Key == termbox.KeySpace {
+					ch = ' '
+				}
+				redraw, clear = viCommand(&ev, ch)
+				break
+			}
+
+			// Discard characters blocked by input filter
+			if fn := inputFilter; fn != nil {
+				allowed := true
+				unlocked(func() {
+					allowed = fn(tev.Ch)
+				})
+				if !allowed {
+					break
+				}
+			}
+
+			// Insert character at cursor position in current history entry
+			pos := bytePos(ev.Cursor, ev.Input)
+			ev.Input = ev.Input[:pos] + string(tev.Ch) + ev.Input[pos:]
+			// Move cursor pos fwd
+			ev.Cursor++
+			redraw = true
+		}
+
+		if prompt {
+			inputChanged(input, cursor, ev)
+		}
+
+		// Redraw input area
+		if clear {
+			clearInputArea(startPos)
+		}
+		if redraw || clear {
+			curPos = startPos
+			drawInput(ev.Cursor, ev.Input, mask, prompt)
+		}
+
+	case termbox.EventMouse:
+		ev.Type = termbox.EventMouse
+		if !prompt {
+			break
+		}
+
+		// Translate mouse event to key press
+		switch tev.Key {
+		case termbox.MouseLeft:
+			// Execute clicked command
+			if name, ok := listingRows[tev.MouseY]; ok {
+				selection = [2]int{}
+				ev.Type = termbox.EventKey
+				ev.Key = termbox.KeyEnter
+				ev.Input = name
+				ev.Cursor = utf8.RuneCountInString(name)
+				break
+			}
+
+			// Call prefix click hook if prefix was clicked
+			if fn := onPrefixClick; fn != nil && (tev.MouseY < prefixEnd.y || tev.MouseY == prefixEnd.y && tev.MouseX < prefixEnd.x) {
+				unlocked(fn)
+				ev.Key = termbox.MouseLeft
+				break
+			}
+
+			// Move cursor pos to clicked position in input
+			runes := []rune(ev.Input)
+			i := (tev.MouseY-startPos.y)*termSize.x + tev.MouseX - startPos.x
+			if tev.MouseY < startPos.y || i < 0 || i > len(runes) {
+				break
+			}
+			ev.Type = termbox.EventKey
+			ev.Cursor = i
+
+			// Select word under pointer on double-click
+			now := time.Now()
+			clickPos := pos{tev.MouseX, tev.MouseY}
+			selection = [2]int{}
+			if clickPos == lastClickPos && now.Sub(lastClick) <= doubleClickInterval {
+				ev.Cursor = selectWord(runes, i)
+				lastClick = time.Time{}
+			} else {
+				lastClick = now
+			}
+			lastClickPos = clickPos
+
+			// Redraw input area
+			curPos = startPos
+			drawInput(ev.Cursor, ev.Input, mask, prompt)
+		case termbox.MouseWheelUp:
+			// Input is replaced by another history entry
+			selection = [2]int{}
+			ev.Type = termbox.EventKey
+			ev.Key = termbox.KeyArrowUp
+		case termbox.MouseWheelDown:
+			selection = [2]int{}
+			ev.Type = termbox.EventKey
+			ev.Key = termbox.KeyArrowDown
+		}
+
+	case termbox.EventResize:
+		ev.Type = termbox.EventResize
+
+		// Store terminal size
+		termSize.x = tev.Width
+		termSize.y = tev.Height
+
+	case termbox.EventError:
+		// Return error
+		ev.Type = termbox.EventError
+		ev.Error = tev.Err
+	}
+
+	return
+}
+
+// SetBellEnabled sets whether Bell alerts the user. Defaults to false.
+func SetBellEnabled(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	bellEnabled = enabled
+}
+
+// SetVisualBell sets whether Bell briefly flashes the terminal instead of
+// ringing the terminal bell
+func SetVisualBell(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	visualBell = enabled
+}
+
+// SetBellOnError sets whether Bell is called when a command is not found or
+// the input is invalid. Defaults to true.
+func SetBellOnError(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	bellOnError = enabled
+}
+
+// SetBeepFunc sets a function used by Bell to alert the user instead of
+// ringing the terminal bell, for terminals where the bell has no effect.
+// Pass nil to ring the terminal bell again.
+func SetBeepFunc(fn func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	beepFunc = fn
+}
+
+// Bell alerts the user by ringing the terminal bell, or by flashing the
+// terminal if visual bell is enabled. It does nothing unless the bell is
+// enabled using SetBellEnabled.
+func Bell() {
+	mu.Lock()
+	defer mu.Unlock()
+	bell()
+}
+
+func errorBell() {
+	mu.Lock()
+	defer mu.Unlock()
+	if bellOnError {
+		bell()
+	}
+}
+
+func bell() {
+	if !bellEnabled {
+		return
+	}
+	if fn := beepFunc; fn != nil {
+		unlocked(fn)
+		return
+	}
+	if !visualBell || closed || suspended {
+		writeEscape("\x07")
+		return
+	}
+
+	// Flash terminal by briefly reversing the colors of all cells. The cells
+	// are restored in the back buffer right away, so anything drawn during the
+	// flash is kept, and shown by the next flush.
+	w, h := termbox.Size()
+	cells := make([]termbox.Cell, len(termbox.CellBuffer()))
+	copy(cells, termbox.CellBuffer())
+	for i, c := range cells {
+		termbox.SetCell(i%w, i/w, c.Ch, c.Fg|termbox.AttrReverse, c.Bg)
+	}
+	termbox.Flush()
+	for i := 0; i < w*h && i < len(cells); i++ {
+		termbox.SetCell(i%w, i/w, cells[i].Ch, cells[i].Fg, cells[i].Bg)
+	}
+	time.AfterFunc(100*time.Millisecond, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed && !suspended {
+			termbox.Flush()
+		}
+	})
+}
+
+// SetTitle sets the terminal window title using an OSC 2 escape sequence.
+// It does nothing if the output writer is not a terminal, or if the terminal
+// is not known to support OSC sequences.
+func SetTitle(s string) {
+	mu.Lock()
+	defer mu.Unlock()
+	setTitle(s)
+}
+
+func setTitle(s string) {
+	f, ok := outputWriter.(*os.File)
+	if !ok {
+		return
+	}
+	if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return
+	}
+	if os.Getenv("COLORTERM") == "" && os.Getenv("TERM_PROGRAM") == "" {
+		return
+	}
+	writeEscape("\x1b]2;" + s + "\x07")
+}
+
+// SetAutoTitle sets a function returning the terminal window title, which is
+// set using SetTitle each time the prompt is drawn. Pass nil to disable it.
+func SetAutoTitle(fn func() string) {
+	mu.Lock()
+	defer mu.Unlock()
+	autoTitle = fn
+}
+
+// SetPromptContinuation sets the prompt shown before each continuation line
+// of multi-line input. Input continues on a new line when a line ending with
+// a backslash is entered. Defaults to "> ".
+func SetPromptContinuation(s string) {
+	mu.Lock()
+	defer mu.Unlock()
+	continuationPrompt = s
+}
+
+// SetContinuationColor sets the color of the continuation prompt. Defaults to
+// termbox.ColorYellow.
+func SetContinuationColor(color termbox.Attribute) {
+	mu.Lock()
+	defer mu.Unlock()
+	continuationColor = color
+}
+
+// SetInputGutter sets a function returning a string drawn in the left margin
+// of each line of input, such as a line number. For multi-line input, the
+// function is called once for each line. Pass nil to disable it.
+func SetInputGutter(fn func() string) {
+	mu.Lock()
+	defer mu.Unlock()
+	inputGutter = fn
+}
+
+// renderGutters returns the gutter of each of n lines of input. The caller
+// must hold mu, which is released while calling the gutter function.
+func renderGutters(n int) []string {
+	gutters := make([]string, n)
+	if fn := inputGutter; fn != nil {
+		unlocked(func() {
+			for i := range gutters {
+				gutters[i] = fn()
+			}
+		})
+	}
+	return gutters
+}
+
+// drawPrompt draws the prefix and current history entry at the top of the
+// terminal, and returns the start position of the input area. The caller
+// must hold mu, which is released while calling the title, prefix and gutter
+// functions, before anything is drawn.
+func drawPrompt(cursor int) pos {
+	if fn := autoTitle; fn != nil {
+		var title string
+		unlocked(func() {
+			title = fn()
+		})
+		setTitle(title)
+	}
+	prefixText := renderPrefix()
+	gutters := renderGutters(len(continuation) + 1)
+
+	cancelValidation()
+	cancelCompletion()
+	selection = [2]int{}
+	statusRow = -1
+	curPos = pos{0, 0}
+	drawText(-1, gutters[0])
+	drawText(-1, prefixText)
+	prefixEnd = curPos
+
+	// Draw previous lines of multi-line input
+	for i, l := range continuation {
+		if i > 0 {
+			drawText(-1, gutters[i])
+			drawTextAttr(-1, continuationPrompt, continuationColor, termbox.ColorDefault)
+		}
+		drawText(-1, l+"\n")
+	}
+	if len(continuation) > 0 {
+		drawText(-1, gutters[len(continuation)])
+		drawTextAttr(-1, continuationPrompt, continuationColor, termbox.ColorDefault)
+	}
+
+	startPos := curPos
+	drawInput(cursor, hist.get(), 0, true)
+	return startPos
+}
+
+// Suspend restores the terminal to its original state, so that a command can
+// run an interactive program. Output is written directly to stdout until
+// Resume is called.
+func Suspend() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if closed {
+		return ErrNotRunning
+	}
+	if suspended {
+		return nil
+	}
+	suspendPos = curPos
+	if pasteHandler != nil {
+		setBracketedPaste(false)
+	}
+	termbox.Close()
+	suspended = true
+	return nil
+}
+
+// Resume reinitializes the terminal after Suspend, redrawing the prompt and
+// restoring the output position
+func Resume() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if closed {
+		return ErrNotRunning
+	}
+	if !suspended {
+		return nil
+	}
+	err := termbox.Init()
+	if err != nil {
+		return err
+	}
+	suspended = false
+	termbox.SetOutputMode(outputMode)
+	if mouseEnabled {
+		termbox.SetInputMode(termbox.InputEsc | termbox.InputMouse)
+	}
+	if pasteHandler != nil {
+		setBracketedPaste(true)
+	}
+
+	// Get terminal size
+	termW, termH := termbox.Size()
+	termSize.x = termW
+	termSize.y = termH
+
+	// Redraw input area and restore output position
+	clearScreen()
+	hist.mu.Lock()
+	drawPrompt(utf8.RuneCountInString(hist.get()))
+	hist.mu.Unlock()
+	curPos = suspendPos
+	return nil
+}
+
+// SetConfirmOnExit sets whether the user is asked to confirm exiting the CLI
+// when it is closed or Ctrl+D is pressed, using prompt as the question. If
+// the user does not answer yes, the CLI keeps running.
+func SetConfirmOnExit(enabled bool, prompt string) {
+	mu.Lock()
+	defer mu.Unlock()
+	confirmOnExit = enabled
+	confirmOnExitPrompt = prompt
+}
+
+// Confirm shows prompt and waits for the user to answer yes or no. Returns
+// true if the user pressed y, or false if any other key was pressed or no CLI
+// is running.
+func Confirm(prompt string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if closed {
+		return false
+	}
+	defer suspendPaging()()
+
+	ok := confirm(prompt)
+
+	// Clear terminal
+	clearScreen()
+	curPos = pos{0, 1}
+
+	return ok
+}
+
+// confirm shows prompt at the top of the terminal and waits for a key press,
+// returning true if the key was y
+func confirm(prompt string) bool {
+	clearScreen()
+	curPos = pos{0, 0}
+	drawText(utf8.RuneCountInString(prompt), prompt)
+	for {
+		switch tev := pollEvent(); tev.Type {
+		case termbox.EventKey:
+			return tev.Ch == 'y' || tev.Ch == 'Y'
+		case termbox.EventResize:
+			termSize.x = tev.Width
+			termSize.y = tev.Height
+		case termbox.EventError:
+			return false
+		}
+	}
+}
+
+// searchHistory shows an incremental search of the input history at the top
+// of the terminal, and returns the selected entry. Pressing Ctrl+R again
+// selects the next match. The caller must hold mu, but not hist.mu.
+func searchHistory() (string, bool) {
+	hist.mu.Lock()
+	entries := hist.originals()
+	hist.mu.Unlock()
+
+	// Normalize entries for searching
+	normalize := searchNormalize
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = normalize(entry)
+	}
+
+	var query []rune
+	var matches []int
+	n := 0
+	for {
+		// Draw search prompt with current match
+		match := ""
+		if n < len(matches) {
+			match = entries[matches[n]]
+		}
+		for y := 0; y <= curPos.y; y++ {
+			clearLine(y)
+		}
+		curPos = pos{0, 0}
+		drawText(-1, "(reverse-i-search)`"+string(query)+"': ")
+		drawText(utf8.RuneCountInString(match), match)
+
+		switch tev := pollEvent(); tev.Type {
+		case termbox.EventKey:
+			switch tev.Key {
+			case termbox.KeyCtrlR:
+				// Select next match
+				if n < len(matches)-1 {
+					n++
+				}
+				continue
+			case termbox.KeyBackspace, termbox.KeyBackspace2:
+				if len(query) == 0 {
+					continue
+				}
+				query = query[:len(query)-1]
+			case termbox.KeySpace:
+				query = append(query, ' ')
+			case 0:
+				query = append(query, tev.Ch)
+			case termbox.KeyCtrlC, termbox.KeyCtrlG, termbox.KeyEsc:
+				return "", false
+			default:
+				return match, match != ""
+			}
+
+			// Search history with updated query, without blocking output
+			// from the search backend
+			fn := searchBackend
+			if fn == nil {
+				fn = searchEntries
+			}
+			var found []int
+			unlocked(func() {
+				found = fn(normalize(string(query)), keys)
+			})
+			matches = matches[:0]
+			for _, i := range found {
+				if i >= 0 && i < len(entries) {
+					matches = append(matches, i)
+				}
+			}
+			n = 0
+		case termbox.EventResize:
+			termSize.x = tev.Width
+			termSize.y = tev.Height
+		case termbox.EventError:
+			return "", false
+		}
+	}
+}
+
+// confirmExit asks the user to confirm exiting the CLI if enabled using
+// SetConfirmOnExit. If the user does not confirm, the CLI keeps running.
+func confirmExit() bool {
+	// Exit was already confirmed in a submode, which outer loops exit after
+	if !confirmOnExit || exitConfirmed {
+		return true
+	}
+	wasClosed := closed
+	closed = false
+	if confirm(confirmOnExitPrompt) {
+		closed = wasClosed
+		exitConfirmed = true
+		return true
+	}
+
+	// Keep running
+	startAutoSave()
+	clearScreen()
+	return false
+}
+
+// Close signals for the CLI to exit on next event. If a history file is set,
+// the history is saved one final time.
+func Close() {
+	mu.Lock()
+	closed = true
+	stopAutoSave()
+	mu.Unlock()
+
+	SaveHistory()
+}
+
+// CLIState is a snapshot of the CLI command list, prefix and key bindings,
+// taken by Checkpoint
+type CLIState struct {
+	list             CommandList
+	prefix           string
+	prefixArgs       []func() interface{}
+	indicator        PromptIndicator
+	inputMode        InputMode
+	wordSeparators   []rune
+	completionPrefix string
+}
+
+// Checkpoint returns a snapshot of the CLI command list, prefix and key
+// bindings. The input history is not included.
+func Checkpoint() *CLIState {
+	mu.RLock()
+	defer mu.RUnlock()
+	return checkpoint()
+}
+
+func checkpoint() *CLIState {
+	return &CLIState{
+		list:             list,
+		prefix:           prefix,
+		prefixArgs:       prefixArgs,
+		indicator:        indicator,
+		inputMode:        inputMode,
+		wordSeparators:   wordSeparators,
+		completionPrefix: completionPrefix,
+	}
+}
+
+// Restore applies a snapshot taken by Checkpoint
+func Restore(s *CLIState) {
+	mu.Lock()
+	defer mu.Unlock()
+	restore(s)
+}
+
+func restore(s *CLIState) {
+	list = s.list
+	prefix = s.prefix
+	prefixArgs = s.prefixArgs
+	indicator = s.indicator
+	inputMode = s.inputMode
+	wordSeparators = s.wordSeparators
+	completionPrefix = s.completionPrefix
+	viNormalMode = false
+	viPendingDelete = false
+}
+
+// RunSubmode runs a nested CLI session with the given command list and
+// prefix, from within a command handler. The session ends when ExitSubmode
+// is called or Ctrl+D is pressed on an empty line, after which the previous
+// command list and prefix are restored, even if the command list was replaced
+// by HotReload during the submode.
+func RunSubmode(l CommandList, p string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if closed {
+		return ErrNotRunning
+	}
+
+	// Switch command list and prefix
+	s := checkpoint()
+	defer restore(s)
+	list = l
+	prefix = p
+	prefixArgs = nil
+
+	// Start submode with an empty input line
+	hist.mu.Lock()
+	if !hist.isLast() {
+		hist.revertAndAdd()
+	}
+	hist.new()
+	hist.mu.Unlock()
+
+	submodeDepth++
+	clearScreen()
+	err := loop()
+	submodeDepth--
+	exitSubmode = false
+
+	// Leave the screen clear for the outer session
+	clearScreen()
+	curPos = pos{0, 1}
+
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// ExitSubmode signals for the innermost submode started by RunSubmode to
+// exit on next event
+func ExitSubmode() {
+	mu.Lock()
+	defer mu.Unlock()
+	if submodeDepth > 0 {
+		exitSubmode = true
+	}
+}
+
+// SetOnStart adds a function to be called when the CLI starts, after the
+// terminal is initialized and before the prompt is first drawn. Functions are
+// called in the order they were added. Returns ErrAlreadyRunning if a CLI is
+// running.
+func SetOnStart(fn func()) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if !closed {
+		return ErrAlreadyRunning
+	}
+	onStart = append(onStart, fn)
+	return nil
+}
+
+// Run sets up a new CLI on the process tty
+func Run() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Reset closed state
+	closed = false
+	suspended = false
+	exitConfirmed = false
+
+	// Initialize terminal
+	err := termbox.Init()
+	if err != nil {
+		closed = true
+		return err
+	}
+	defer func() {
+		closed = true
+		if !suspended {
+			if pasteHandler != nil {
+				setBracketedPaste(false)
+			}
+			termbox.Close()
+		}
+	}()
+	termbox.SetOutputMode(outputMode)
+	if mouseEnabled {
+		termbox.SetInputMode(termbox.InputEsc | termbox.InputMouse)
+	}
+	if pasteHandler != nil {
+		setBracketedPaste(true)
+	}
+
+	// Get initial terminal size
+	termW, termH := termbox.Size()
+	termSize.x = termW
+	termSize.y = termH
+
+	// Start saving history periodically, and save it one final time on exit,
+	// including on Ctrl+D
+	defer SaveHistory()
+	startAutoSave()
+	defer stopAutoSave()
+
+	// Call start functions, with output below the prompt
+	curPos = pos{0, 1}
+	fns := onStart
+	unlocked(func() {
+		for _, fn := range fns {
+			fn()
+		}
+	})
+	endOutput()
+
+	return loop()
+}
+
+// loop handles input events until the CLI is closed or the current submode
+// exits. The caller must hold mu.
+func loop() error {
+	var cursor int
+
+	// Completions cycled through by pressing Tab, and the input they replace
+	var cycle []string
+	var cycleIndex int
+	var cycleLine, cycleCompleted string
+
+	// Draw input area
+	startPos := drawPrompt(cursor)
+
+	for {
+		hist.mu.Lock()
+		input := hist.get()
+		hist.mu.Unlock()
+
+		normalMode := viNormalMode
+
+		switch ev := getInput(startPos, cursor, input, 0, true); ev.Type {
+		case termbox.EventKey:
+			hist.mu.Lock()
+
+			// Clear terminal if new log entry and character was entered
+			if clearOnExec && hist.isLast() && hist.get() == "" && ev.Input != "" {
+				clearArea(curPos, termSize)
+				listingRows = nil
+				termbox.Flush()
 			}
 
 			cursor = ev.Cursor
-			log.set(ev.Input)
+			hist.set(ev.Input)
+
+			// Redraw prefix if vi mode changed
+			if viNormalMode != normalMode {
+				clearArea(pos{0, 0}, curPos)
+				startPos = drawPrompt(cursor)
+			}
+
+			// Complete input once the completion delay has passed, if the
+			// loop was interrupted for it rather than by a key press
+			due := completeDue
+			completeDue = false
+			if line := hist.get(); due && ev.Key == 0 && ev.Input == input && !viNormalMode && cursor == utf8.RuneCountInString(line) && canComplete(line) {
+				if completed := completeLine(line); completed != line {
+					cursor = setCompletion(startPos, line, completed)
+				}
+			}
+
+			// Navigate history using Page Up and Page Down
+			if pageUpDownInHistory {
+				switch ev.Key {
+				case termbox.KeyPgup:
+					ev.Key = termbox.KeyArrowUp
+				case termbox.KeyPgdn:
+					ev.Key = termbox.KeyArrowDown
+				}
+			}
 
 			switch ev.Key {
 			case termbox.KeyCtrlC:
 				// Clear terminal
-				termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
-				curPos = pos{0, 1}
+				clearInput()
+				curPos = outputStart()
+				continuation = nil
 
 				// Revert current history entry and go to last history entry
-				if log.isLast() {
-					log.set("")
+				if hist.isLast() {
+					hist.set("")
 				} else {
-					log.revert()
-					log.last()
+					hist.revert()
+					hist.last()
 				}
 
 				// Move cursor pos to end
-				cursor = utf8.RuneCountInString(log.get())
+				cursor = utf8.RuneCountInString(hist.get())
 
 				// Redraw input area
-				curPos = pos{0, 0}
-				drawText(-1, prefix)
-				startPos = curPos
-				drawText(cursor, log.get())
+				startPos = drawPrompt(cursor)
 
 			case termbox.KeyEnter:
 				// Clear terminal
-				termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
-				curPos = pos{0, 1}
+				clearInput()
+				curPos = outputStart()
+
+				// Continue input on a new line if line ends with an unescaped
+				// backslash
+				line := hist.get()
+				if continuesLine(line) {
+					continuation = append(continuation, strings.TrimSuffix(line, "\\"))
+					hist.set("")
+					cursor = 0
+					startPos = drawPrompt(cursor)
+					break
+				}
+				if len(continuation) > 0 {
+					line = strings.Join(append(continuation, line), " ")
+					continuation = nil
+					hist.set(line)
+				}
+
+				// Let the enter hook consume the input
+				if fn := onEnter; fn != nil {
+					var dispatch bool
+					hist.mu.Unlock()
+					unlocked(func() {
+						dispatch = fn(line)
+					})
+					hist.mu.Lock()
+					endOutput()
+					if closed || exitSubmode {
+						hist.mu.Unlock()
+						if exitSubmode || confirmExit() {
+							return nil
+						}
+						hist.mu.Lock()
+					}
+					if !dispatch {
+						// Discard input without adding a history entry
+						if hist.isLast() {
+							hist.set("")
+						} else {
+							hist.revert()
+							hist.last()
+						}
+						cursor = 0
+						startPos = drawPrompt(cursor)
+						break
+					}
+				}
 
 				// Attempt to execute command in current history entry
-				if Exec(strings.Split(strings.Trim(log.get(), " "), " ")) {
-					if closed {
-						return nil
+				hist.mu.Unlock()
+				err := execPrompt(line)
+				hist.mu.Lock()
+				endOutput()
+				if err == nil {
+					if closed || exitSubmode {
+						hist.mu.Unlock()
+						if exitSubmode || confirmExit() {
+							return nil
+						}
+						hist.mu.Lock()
 					}
 
+					// Return to vi insert mode for the next command
+					viNormalMode = false
+					viPendingDelete = false
+
 					// If entry is not last, insert new history entry with edited contents and
 					// restore any edits to original
-					if !log.isLast() {
-						log.revertAndAdd()
+					if !hist.isLast() {
+						hist.revertAndAdd()
 					}
 
-					log.new()
+					hist.new()
 					cursor = 0
 				}
 
 				// Redraw input area
-				curPos = pos{0, 0}
-				drawText(-1, prefix)
-				startPos = curPos
-				drawText(cursor, log.get())
+				startPos = drawPrompt(cursor)
 
 			case termbox.KeyTab:
-				// Clear terminal
-				termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
+				if !autoComplete.TriggerOnTab {
+					break
+				}
+
+				// Complete command in current history entry if only one command matches
+				line := hist.get()
+				if completed := completeLine(line); completed != line && canComplete(line) {
+					cycle = nil
+					cursor = setCompletion(startPos, line, completed)
+					break
+				}
+
+				// Cycle through completions if multiple commands match
+				if fn := onTabCycle; fn != nil {
+					if cycle != nil && line == cycleCompleted {
+						cycleIndex++
+					} else if !canComplete(line) {
+						cycle = nil
+					} else {
+						cycle, cycleIndex, cycleLine = completions(line), 0, line
+					}
+					if len(cycle) > 1 {
+						var word string
+						hist.mu.Unlock()
+						unlocked(func() {
+							word = fn(cycle, cycleIndex)
+						})
+						hist.mu.Lock()
+						cycleCompleted = cycleLine[:len(cycleLine)-len(lastWord(cycleLine))] + word
+						cursor = setCompletion(startPos, line, cycleCompleted)
+						break
+					}
+					cycle = nil
+				}
+
+				if !hasMatches(line) {
+					// Call no match hook instead of listing if no command matches
+					fn := onTabNoMatch
+					if fn != nil {
+						hist.mu.Unlock()
+						unlocked(func() {
+							fn(line)
+						})
+						hist.mu.Lock()
+					}
+
+					// Correct last command word to the closest command
+					if tabCorrection && hist.get() == line {
+						if corrected := correctLine(line); corrected != line {
+							cycle = nil
+							cursor = setInput(startPos, corrected)
+							break
+						}
+					}
+					if fn != nil {
+						break
+					}
+				}
+
+				// List commands matching current history entry
+				listCommands(line)
+
+				// Redraw input area
+				startPos = drawPrompt(cursor)
+
+			case termbox.KeySpace:
+				// Complete command word before inserted space
+				line := hist.get()
+				word := strings.TrimSuffix(line, " ")
+				if !autoComplete.TriggerOnSpace || viNormalMode || word == line || word == "" || strings.HasSuffix(word, " ") || cursor != utf8.RuneCountInString(line) || !canComplete(word) {
+					break
+				}
+				if completed := completeLine(word); completed != word {
+					if !strings.HasSuffix(completed, " ") && !strings.HasSuffix(completed, string(fieldSeparator)) {
+						completed += " "
+					}
+					if completed != line {
+						cursor = setCompletion(startPos, line, completed)
+						line = completed
+					}
+				}
+
+				// List commands of completed submenu
+				if isSubmenu(line) {
+					listCommands(strings.TrimRight(line, " "))
+					startPos = drawPrompt(cursor)
+				}
 
-				// Autocomplete command in current history entry
-				curPos.x = 0
-				curPos.y++
-				Exec(strings.Split(strings.Trim(log.get()+" ?", " "), " "))
+			case termbox.KeyCtrlR:
+				// Search history, and replace input with selected entry
+				hist.mu.Unlock()
+				match, ok := searchHistory()
+				hist.mu.Lock()
+				if ok {
+					hist.set(match)
+					cursor = utf8.RuneCountInString(match)
+				}
 
 				// Redraw input area
-				curPos = pos{0, 0}
-				drawText(-1, prefix)
-				startPos = curPos
-				drawText(cursor, log.get())
+				clearInput()
+				startPos = drawPrompt(cursor)
 
 			case termbox.KeyArrowUp:
 				// If history has a previous entry
-				if log.prev() {
+				if hist.prev() {
 					// Clear terminal
-					termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
+					clearInput()
 					// Move cursor pos to end
-					cursor = utf8.RuneCountInString(log.get())
+					cursor = utf8.RuneCountInString(hist.get())
 					// Redraw input area
-					curPos = pos{0, 0}
-					drawText(-1, prefix)
-					startPos = curPos
-					drawText(cursor, log.get())
+					startPos = drawPrompt(cursor)
 				}
 
 			case termbox.KeyArrowDown:
 				// If history has a next entry
-				if log.next() {
+				if hist.next() {
 					// Clear terminal
-					termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
+					clearInput()
 					// Move cursor pos to end
-					cursor = utf8.RuneCountInString(log.get())
+					cursor = utf8.RuneCountInString(hist.get())
 					// Redraw input area
-					curPos = pos{0, 0}
-					drawText(-1, prefix)
-					startPos = curPos
-					drawText(cursor, log.get())
+					startPos = drawPrompt(cursor)
+				}
+			}
+
+			hist.mu.Unlock()
+
+			// Validate edited input
+			var invalid bool
+			if ev.Input != input && inputValidator != nil {
+				if inputEchoDelay > 0 {
+					scheduleValidation(ev.Input)
+				} else {
+					fn := inputValidator
+					var err error
+					unlocked(func() {
+						err = fn(ev.Input)
+					})
+					drawStatus(err)
+					invalid = err != nil
 				}
 			}
 
+			// Schedule completion of edited input
+			if ev.Input != input && autoComplete.TriggerOnDelay > 0 {
+				scheduleCompletion()
+			}
+
+			// Show description of matching command, unless input is invalid
+			if ev.Input != input && contextualHelp && !invalid {
+				drawStatusText(contextHint(ev.Input), "\x1b[90m")
+			}
+
+		case termbox.EventMouse:
+			// Redraw input area after prefix click, as the prefix may have
+			// changed
+			if ev.Key == termbox.MouseLeft {
+				hist.mu.Lock()
+				clearArea(pos{0, 0}, curPos)
+				startPos = drawPrompt(cursor)
+				hist.mu.Unlock()
+			}
+
+		case termbox.EventResize:
+			// Redraw input area
+			clearScreen()
+			hist.mu.Lock()
+			startPos = drawPrompt(cursor)
+			hist.mu.Unlock()
+			resized()
+
 		case termbox.EventError:
+			// Ask to confirm exit on Ctrl+D or when closed
+			if ev.Error == ErrNotRunning || ev.Error == io.EOF && submodeDepth == 0 {
+				if !confirmExit() {
+					hist.mu.Lock()
+					startPos = drawPrompt(cursor)
+					hist.mu.Unlock()
+					break
+				}
+			}
 			return ev.Error
 		}
 	}
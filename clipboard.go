@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ErrNoClipboard is returned when no clipboard command is available
+var ErrNoClipboard = errors.New("no clipboard command found")
+
+// Clipboard provides access to the system clipboard
+type Clipboard interface {
+	Read() (string, error)
+	Write(s string) error
+}
+
+// SetClipboard sets the clipboard used to copy selected text, and to paste
+// text with Ctrl+V. Pass nil to copy using OSC 52 escape sequences, and
+// disable Ctrl+V.
+func SetClipboard(board Clipboard) {
+	mu.Lock()
+	defer mu.Unlock()
+	clipboard = board
+}
+
+// DefaultClipboard returns a Clipboard using the clipboard commands of the
+// operating system: pbcopy and pbpaste on macOS, clip.exe and PowerShell on
+// Windows, and xclip or xsel elsewhere
+func DefaultClipboard() Clipboard {
+	return commandClipboard{}
+}
+
+type commandClipboard struct{}
+
+func (commandClipboard) Read() (string, error) {
+	args, err := clipboardCommand(false)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return "", err
+	}
+	s := string(out)
+	if runtime.GOOS == "windows" {
+		// Get-Clipboard adds a line ending
+		s = strings.TrimSuffix(s, "\r\n")
+	}
+	return s, nil
+}
+
+func (commandClipboard) Write(s string) error {
+	args, err := clipboardCommand(true)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(s)
+	return cmd.Run()
+}
+
+func clipboardCommand(write bool) ([]string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		if write {
+			return []string{"pbcopy"}, nil
+		}
+		return []string{"pbpaste"}, nil
+	case "windows":
+		if write {
+			return []string{"clip.exe"}, nil
+		}
+		return []string{"powershell.exe", "-NoProfile", "-Command", "Get-Clipboard"}, nil
+	}
+
+	if _, err := exec.LookPath("xclip"); err == nil {
+		if write {
+			return []string{"xclip", "-selection", "clipboard", "-in"}, nil
+		}
+		return []string{"xclip", "-selection", "clipboard", "-out"}, nil
+	}
+	if _, err := exec.LookPath("xsel"); err == nil {
+		if write {
+			return []string{"xsel", "--clipboard", "--input"}, nil
+		}
+		return []string{"xsel", "--clipboard", "--output"}, nil
+	}
+	return nil, ErrNoClipboard
+}
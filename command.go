@@ -1,8 +1,14 @@
 package cli
 
 import (
+	"context"
 	"errors"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ErrInvalidPath is returned when a CommandList path is not found
@@ -11,21 +17,385 @@ var ErrInvalidPath = errors.New("invalid path")
 // CommandHandler defines the function ran when executing a Command
 type CommandHandler func(args []string)
 
+// ContextHandler defines the function ran when executing a Command, with a
+// context which is cancelled when the command times out
+type ContextHandler func(ctx context.Context, args []string)
+
 // Command is a structure for storing a single command item.
 // You cannot store the name of a command inside itself.
 // Use a CommandList to store commands by name.
 //
 // A Command containing other commands may not have a handler set.
+// ContextHandler is run in place of Handler if set, and receives a context
+// which is cancelled when the command is run by ExecWithTimeout and times
+// out.
+//
+// Commands with a Category are grouped under their category when listed.
+// LongDescription is shown in place of Description in exported
+// documentation. ExampleUsage holds example invocations, printed along with
+// the usage message when a command is given the wrong arguments.
+//
+// InvocationCount and LastUsed are updated by Exec each time the command
+// handler runs. InvocationCount is kept as the first field to guarantee
+// 64-bit alignment for atomic access.
 type Command struct {
-	Description string
-	Arguments   []string
-	Handler     CommandHandler
-	List        CommandList
+	InvocationCount int64
+	Description     string
+	LongDescription string
+	Category        string
+	Arguments       []string
+	ExampleUsage    []string
+	Handler         CommandHandler
+	ContextHandler  ContextHandler
+	List            CommandList
+	LastUsed        time.Time
+}
+
+// usageMu guards LastUsed of all commands, so that Command remains a plain
+// struct which may be copied
+var usageMu sync.Mutex
+
+// CommandStats is a snapshot of the usage of a single command
+type CommandStats struct {
+	InvocationCount int64
+	LastUsed        time.Time
+}
+
+// hasHandler returns whether the command has a handler of either kind
+func (c *Command) hasHandler() bool {
+	return c.Handler != nil || c.ContextHandler != nil
+}
+
+// run calls the handler of the command with ctx and args
+func (c *Command) run(ctx context.Context, args []string) {
+	if c.ContextHandler != nil {
+		c.ContextHandler(ctx, args)
+		return
+	}
+	c.Handler(args)
+}
+
+func (c *Command) recordUsage() {
+	atomic.AddInt64(&c.InvocationCount, 1)
+	usageMu.Lock()
+	c.LastUsed = time.Now()
+	usageMu.Unlock()
+}
+
+func (c *Command) usage() CommandStats {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	return CommandStats{
+		InvocationCount: atomic.LoadInt64(&c.InvocationCount),
+		LastUsed:        c.LastUsed,
+	}
 }
 
 // CommandList is a collection of commands stored by name
 type CommandList map[string]*Command
 
+// UsageStats returns a snapshot of the usage of all commands in the list,
+// including nested commands, stored by their full path
+func (l CommandList) UsageStats() map[string]CommandStats {
+	stats := map[string]CommandStats{}
+	l.usageStats("", stats)
+	return stats
+}
+
+func (l CommandList) usageStats(prefix string, stats map[string]CommandStats) {
+	for name, item := range l {
+		name = joinPath(prefix, name)
+		stats[name] = item.usage()
+		item.List.usageStats(name, stats)
+	}
+}
+
+// CommandListDiff holds the full paths of commands which differ between two
+// command lists
+type CommandListDiff struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+// Diff compares the list to other, and returns the paths of commands added
+// in other, removed from the list, and modified. A command is modified if its
+// description, arguments, handler or set of subcommands changed.
+func (l CommandList) Diff(other CommandList) CommandListDiff {
+	var d CommandListDiff
+	diffLists("", l, other, &d)
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+	return d
+}
+
+func diffLists(prefix string, a, b CommandList, d *CommandListDiff) {
+	for name, item := range a {
+		path := joinPath(prefix, name)
+		if other, ok := b[name]; ok {
+			if !sameCommand(item, other) {
+				d.Modified = append(d.Modified, path)
+			}
+			diffLists(path, item.List, other.List, d)
+		} else {
+			d.Removed = append(d.Removed, path)
+			diffLists(path, item.List, nil, d)
+		}
+	}
+	for name, item := range b {
+		if _, ok := a[name]; !ok {
+			path := joinPath(prefix, name)
+			d.Added = append(d.Added, path)
+			diffLists(path, nil, item.List, d)
+		}
+	}
+}
+
+func sameCommand(a, b *Command) bool {
+	if a.Description != b.Description || !reflect.DeepEqual(a.Arguments, b.Arguments) {
+		return false
+	}
+	if reflect.ValueOf(a.Handler).Pointer() != reflect.ValueOf(b.Handler).Pointer() {
+		return false
+	}
+	if reflect.ValueOf(a.ContextHandler).Pointer() != reflect.ValueOf(b.ContextHandler).Pointer() {
+		return false
+	}
+	if len(a.List) != len(b.List) {
+		return false
+	}
+	for name := range a.List {
+		if _, ok := b.List[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+var onCommandAdd func(path []string, cmd *Command)
+var onCommandRemove func(path []string)
+
+// SetOnCommandAdd sets a function to be called with the path and the command
+// each time a command is added using CommandList.AddGroup. The path is
+// relative to the list the command was added to. Pass nil to disable it.
+func SetOnCommandAdd(fn func(path []string, cmd *Command)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onCommandAdd = fn
+}
+
+// SetOnCommandRemove sets a function to be called with the path of each
+// command removed using CommandList.Remove, including parent commands removed
+// by WithCascadeRemove. The path is relative to the list the command was
+// removed from. Pass nil to disable it.
+func SetOnCommandRemove(fn func(path []string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onCommandRemove = fn
+}
+
+// AddGroup adds a command named name containing the commands in sub, with no
+// handler of its own, and returns it. Panics if the list already contains a
+// command named name.
+func (l CommandList) AddGroup(name, description string, sub CommandList) *Command {
+	mu.Lock()
+	if _, ok := l[name]; ok {
+		mu.Unlock()
+		panic("command \"" + name + "\" already exists")
+	}
+	item := &Command{
+		Description: description,
+		List:        sub,
+	}
+	l[name] = item
+	fn := onCommandAdd
+	mu.Unlock()
+
+	// Notify after the command is added, without holding the lock
+	if fn != nil {
+		fn([]string{name}, item)
+	}
+	return item
+}
+
+// SubList returns the command list of the command at path, matching each
+// name exactly. The returned list is the list stored in the command, so
+// commands added to it are added to the command. If the command has no list,
+// an empty list is set for it. Returns the list itself if path is empty, or
+// ErrInvalidPath if no command exists at path.
+func (l CommandList) SubList(path []string) (CommandList, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var item *Command
+	for _, name := range path {
+		if item = l[name]; item == nil {
+			return nil, ErrInvalidPath
+		}
+		l = item.List
+	}
+	if item != nil && item.List == nil {
+		item.List = CommandList{}
+		l = item.List
+	}
+	return l, nil
+}
+
+// SetCommandHelp sets the long description of the command at path in the
+// current command list, and adds example to its usage examples. Empty
+// strings are ignored. Returns ErrInvalidPath if no command exists at path.
+func SetCommandHelp(path []string, long, example string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(path) == 0 {
+		return ErrInvalidPath
+	}
+	var item *Command
+	l := list
+	for _, name := range path {
+		if item = l[name]; item == nil {
+			return ErrInvalidPath
+		}
+		l = item.List
+	}
+	if long != "" {
+		item.LongDescription = long
+	}
+	if example != "" {
+		item.ExampleUsage = append(item.ExampleUsage, example)
+	}
+	return nil
+}
+
+// RemoveOption sets an option for CommandList.Remove
+type RemoveOption func(o *removeOptions)
+
+type removeOptions struct {
+	cascade bool
+}
+
+// WithCascadeRemove sets whether parent commands left with no subcommands and
+// no handler are removed as well
+func WithCascadeRemove(cascade bool) RemoveOption {
+	return func(o *removeOptions) {
+		o.cascade = cascade
+	}
+}
+
+// Remove removes the command at path from the list, along with its
+// subcommands. Returns ErrInvalidPath if no command exists at path.
+func (l CommandList) Remove(path []string, opts ...RemoveOption) error {
+	var o removeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if len(path) == 0 {
+		return ErrInvalidPath
+	}
+
+	mu.Lock()
+	removed, err := l.remove(path, o)
+	fn := onCommandRemove
+	mu.Unlock()
+
+	// Notify after all commands are removed, without holding the lock
+	if fn != nil {
+		for _, p := range removed {
+			fn(p)
+		}
+	}
+	return err
+}
+
+// remove removes the command at path from the list, and returns the paths of
+// all removed commands. The caller must hold mu.
+func (l CommandList) remove(path []string, o removeOptions) ([][]string, error) {
+	// Find the list containing each path segment
+	lists := []CommandList{l}
+	for _, name := range path[:len(path)-1] {
+		item := lists[len(lists)-1][name]
+		if item == nil {
+			return nil, ErrInvalidPath
+		}
+		lists = append(lists, item.List)
+	}
+	name := path[len(path)-1]
+	if lists[len(lists)-1][name] == nil {
+		return nil, ErrInvalidPath
+	}
+	delete(lists[len(lists)-1], name)
+	removed := [][]string{path}
+
+	// Remove empty parent commands
+	if o.cascade {
+		for i := len(lists) - 1; i > 0; i-- {
+			parent := lists[i-1][path[i-1]]
+			if len(parent.List) > 0 || parent.hasHandler() {
+				break
+			}
+			delete(lists[i-1], path[i-1])
+			removed = append(removed, path[:i])
+		}
+	}
+
+	return removed, nil
+}
+
+// listGet returns the command stored under key in l, falling back to a case
+// insensitive search if completion is not case sensitive
+func listGet(l CommandList, key string) *Command {
+	if item := l[key]; item != nil || completionCaseSensitive {
+		return item
+	}
+	return listGetFold(l, key)
+}
+
+// listGetFold returns the command stored under key in l, ignoring case
+func listGetFold(l CommandList, key string) *Command {
+	for name, item := range l {
+		if strings.EqualFold(name, key) {
+			return item
+		}
+	}
+	return nil
+}
+
+// lookup returns the command in l named word, or the single command whose
+// name starts with word
+func (l CommandList) lookup(word string) *Command {
+	if item := listGet(l, word); item != nil {
+		return item
+	}
+	var match *Command
+	for name, item := range l {
+		if hasNamePrefix(name, word) {
+			if match != nil {
+				return nil
+			}
+			match = item
+		}
+	}
+	return match
+}
+
+func hasNamePrefix(name, prefix string) bool {
+	if !completionCaseSensitive {
+		return strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix))
+	}
+	return strings.HasPrefix(name, prefix)
+}
+
+// joinPath appends name to a command path using the field separator
+func joinPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + string(fieldSeparator) + name
+}
+
 func (l CommandList) resolvePath(path []string) (possibilities CommandList, args []string, list bool) {
 	if path == nil || len(path) == 0 || len(path) == 1 && path[0] == "" {
 		return
@@ -45,31 +415,31 @@ func (l CommandList) resolvePath(path []string) (possibilities CommandList, args
 		if len(*curList) == 0 {
 			break
 		}
-		if (*curList)[path[i]] != nil {
+		if item := listGet(*curList, path[i]); item != nil {
 			// Exact match
-			curCmd = (*curList)[path[i]]
+			curCmd = item
 			curList = &curCmd.List
 			argsIndex++
 
 			possibilities = CommandList{}
-			prefix = strings.Join(path[:i+1], " ")
+			prefix = strings.Join(path[:i+1], string(fieldSeparator))
 			possibilities[prefix] = curCmd
 		} else {
 			// Search
 			possibilities = CommandList{}
 			for name, item := range *curList {
-				if strings.HasPrefix(name, path[i]) {
-					possibilities[strings.TrimLeft(prefix+" "+name, " ")] = item
+				if hasNamePrefix(name, path[i]) {
+					possibilities[joinPath(prefix, name)] = item
 				}
 			}
-			if len(possibilities) == 1 {
+			if len(possibilities) == 1 && abbreviationExpansion {
 				// Single match
 				for name, item := range possibilities {
 					curCmd = item
 					curList = &curCmd.List
 					argsIndex++
 
-					prefix = strings.TrimLeft(prefix+" "+name, " ")
+					prefix = joinPath(prefix, name)
 					break
 				}
 			} else {
@@ -85,9 +455,9 @@ func (l CommandList) resolvePath(path []string) (possibilities CommandList, args
 			panic("parent item cannot have arguments")
 		}
 
-		if list || curCmd != nil && curCmd.Handler == nil {
+		if list || curCmd != nil && !curCmd.hasHandler() {
 			for name, item := range *curList {
-				possibilities[strings.TrimLeft(prefix+" "+name, " ")] = item
+				possibilities[joinPath(prefix, name)] = item
 			}
 		}
 	}
@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+// ManPageMeta holds the information about a program shown in a man page
+// generated by ExportManPage
+type ManPageMeta struct {
+	Name         string
+	Version      string
+	Section      string
+	Author       string
+	BugReportURL string
+	Description  string
+}
+
+// walkCommands calls fn with the full path of each command in l and its
+// nested command lists, in the order set by SetCommandSorter
+func walkCommands(l CommandList, prefix string, fn func(path string, item *Command)) {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	for _, name := range sortNames(names) {
+		path := joinPath(prefix, name)
+		fn(path, l[name])
+		walkCommands(l[name].List, path, fn)
+	}
+}
+
+// longDescription returns the long description of a command, falling back
+// to its description
+func (c *Command) longDescription() string {
+	if c.LongDescription != "" {
+		return c.LongDescription
+	}
+	return c.Description
+}
+
+// formatUsage returns the usage line of a command with the given arguments
+func formatUsage(path string, args []string) string {
+	if len(args) == 1 && args[0] == "*" {
+		return path + " [arguments...]"
+	}
+	for _, arg := range args {
+		path += " <" + arg + ">"
+	}
+	return path
+}
+
+// manEscape escapes text for use in groff source
+func manEscape(s string) string {
+	s = strings.Replace(s, "\\", "\\e", -1)
+	s = strings.Replace(s, "-", "\\-", -1)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		// Prevent lines from being read as requests
+		if strings.HasPrefix(l, ".") || strings.HasPrefix(l, "'") {
+			lines[i] = "\\&" + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ExportManPage writes a man page in groff format documenting all commands
+// of the current command list, which can be viewed using "man -l".
+// Commands without a handler are listed only through their subcommands.
+func ExportManPage(w io.Writer, meta ManPageMeta) error {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	section := meta.Section
+	if section == "" {
+		section = "1"
+	}
+
+	b := bufio.NewWriter(w)
+	b.WriteString(".TH \"" + manEscape(strings.ToUpper(meta.Name)) + "\" \"" + manEscape(section) + "\" \"" + time.Now().Format("2006-01-02") + "\" \"" + manEscape(strings.TrimSpace(meta.Name+" "+meta.Version)) + "\"\n")
+
+	b.WriteString(".SH NAME\n")
+	b.WriteString(manEscape(meta.Name) + "\n")
+
+	b.WriteString(".SH SYNOPSIS\n")
+	b.WriteString(".B " + manEscape(meta.Name) + "\n")
+	b.WriteString("[\\fIcommand\\fR [\\fIarguments\\fR]]\n")
+
+	if meta.Description != "" {
+		b.WriteString(".SH DESCRIPTION\n")
+		b.WriteString(manEscape(meta.Description) + "\n")
+	}
+
+	b.WriteString(".SH COMMANDS\n")
+	walkCommands(list, "", func(path string, item *Command) {
+		if !item.hasHandler() {
+			return
+		}
+		b.WriteString(".TP\n")
+		b.WriteString(".B " + manEscape(formatUsage(path, item.Arguments)) + "\n")
+		if desc := item.longDescription(); desc != "" {
+			b.WriteString(manEscape(desc) + "\n")
+		}
+		if len(item.ExampleUsage) > 0 {
+			b.WriteString(".RS\n.PP\nExamples:\n.nf\n")
+			for _, example := range item.ExampleUsage {
+				b.WriteString(manEscape(example) + "\n")
+			}
+			b.WriteString(".fi\n.RE\n")
+		}
+	})
+
+	if meta.Author != "" {
+		b.WriteString(".SH AUTHOR\n")
+		b.WriteString(manEscape(meta.Author) + "\n")
+	}
+	if meta.BugReportURL != "" {
+		b.WriteString(".SH REPORTING BUGS\n")
+		b.WriteString("Report bugs at " + manEscape(meta.BugReportURL) + "\n")
+	}
+
+	return b.Flush()
+}
+
+// ExportMarkdown writes a Markdown document describing all commands of the
+// current command list. Each top-level command has its own section, with
+// nested commands in subsections below it.
+func ExportMarkdown(w io.Writer) error {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	b := bufio.NewWriter(w)
+	first := true
+	walkCommands(list, "", func(path string, item *Command) {
+		// Nest headings by path depth, up to the deepest heading level
+		depth := strings.Count(path, string(fieldSeparator))
+		if depth > 4 {
+			depth = 4
+		}
+		if !first {
+			b.WriteString("\n")
+		}
+		first = false
+		b.WriteString(strings.Repeat("#", depth+2) + " " + path + "\n")
+
+		if desc := item.longDescription(); desc != "" {
+			b.WriteString("\n" + desc + "\n")
+		}
+		if item.hasHandler() {
+			b.WriteString("\nUsage: `" + formatUsage(path, item.Arguments) + "`\n")
+		}
+		if len(item.ExampleUsage) > 0 {
+			b.WriteString("\nExamples:\n```\n")
+			for _, example := range item.ExampleUsage {
+				b.WriteString(example + "\n")
+			}
+			b.WriteString("```\n")
+		}
+	})
+	return b.Flush()
+}
@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 	"unicode/utf8"
@@ -8,28 +10,352 @@ import (
 	"github.com/alexrsagen/termbox-go"
 )
 
+// ErrInvalidFieldIndex is returned when a field index is out of range
+var ErrInvalidFieldIndex = errors.New("invalid field index")
+
+// ErrFieldRequired is returned when a required field is empty
+var ErrFieldRequired = errors.New("required")
+
+// ErrFieldFormat is returned when a field input does not match its format
+var ErrFieldFormat = errors.New("invalid format")
+
+// ErrFieldOption is returned when a field input is not one of its options
+var ErrFieldOption = errors.New("not a valid option")
+
+// FieldInputMode is a mode of editing form fields, set by SetFieldInputMode
+type FieldInputMode int
+
+// Field input modes
+const (
+	// FieldInputSingleLine submits the form when Enter is pressed on the
+	// last field (default)
+	FieldInputSingleLine FieldInputMode = iota
+	// FieldInputMultiLine inserts a line break when Enter is pressed, and
+	// submits the form when Ctrl+J is pressed
+	FieldInputMultiLine
+)
+
+var fieldInputMode = FieldInputSingleLine
+
+// SetFieldInputMode sets whether form fields are single-line or multi-line
+func SetFieldInputMode(mode FieldInputMode) {
+	mu.Lock()
+	defer mu.Unlock()
+	fieldInputMode = mode
+}
+
+// FormStyle is a layout of form fields, set by SetFormStyle
+type FormStyle int
+
+// Form styles
+const (
+	// FormStyleDefault shows the input of each field on the same line as its
+	// name (default)
+	FormStyleDefault FormStyle = iota
+	// FormStyleStacked shows the input of each field indented on the line
+	// below its name
+	FormStyleStacked
+	// FormStyleBordered shows each field in a box, with its name in the top
+	// border of the box
+	FormStyleBordered
+)
+
+var formStyle = FormStyleDefault
+
+// SetFormStyle sets the layout of form fields
+func SetFormStyle(style FormStyle) {
+	mu.Lock()
+	defer mu.Unlock()
+	formStyle = style
+}
+
+var inputMaskChar rune
+
+// SetInputMaskChar sets the rune displayed in place of each input character
+// of form fields without a Mask of their own. Pass 0 to show the input of
+// such fields (default).
+func SetInputMaskChar(r rune) {
+	mu.Lock()
+	defer mu.Unlock()
+	inputMaskChar = r
+}
+
+// GetInputMaskChar returns the rune set by SetInputMaskChar
+func GetInputMaskChar() rune {
+	mu.RLock()
+	defer mu.RUnlock()
+	return inputMaskChar
+}
+
+var fieldAutoFocus bool
+
+// SetFieldAutoFocus sets whether forms automatically focus the first invalid
+// field, such as an empty required field, when displayed, and when displayed
+// again after validation failed. A field focused using FocusField takes precedence
+// when the form is first displayed.
+func SetFieldAutoFocus(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	fieldAutoFocus = enabled
+}
+
+var fieldAutoSubmit bool
+
+// activeField is the field being edited in a displayed form, and activeCursor
+// is the cursor position within it
+var activeField *Field
+var activeCursor int
+
+// SetFieldAutoSubmit sets whether all form fields with a MaxLen move to the
+// next field, or submit the form from the last field, once MaxLen characters
+// are entered, as if AutoSubmit was set on each of them
+func SetFieldAutoSubmit(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	fieldAutoSubmit = enabled
+}
+
+var onFormSubmit func(fl FieldList) error
+
+// SetOnFormSubmit sets a function to be called with the fields of a form once
+// its input is valid, before Form returns. If the function returns an error,
+// the form is displayed again with the error shown above it. Pass nil to
+// disable it.
+func SetOnFormSubmit(fn func(fl FieldList) error) {
+	mu.Lock()
+	defer mu.Unlock()
+	onFormSubmit = fn
+}
+
+var onFieldChange func(field *Field, oldVal, newVal string)
+
+// SetOnFieldChange sets a function to be called each time the input of a
+// form field changes while a form is displayed. The function may modify the
+// Input and Options of other fields, and the form is redrawn after it
+// returns. Pass nil to disable it.
+func SetOnFieldChange(fn func(field *Field, oldVal, newVal string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onFieldChange = fn
+}
+
 type drawableForm interface {
 	drawForm()
 }
 
-// Field is a structure containing a single form field
+// submitErrorForm is a form drawn below the error returned by the function
+// set by SetOnFormSubmit
+type submitErrorForm struct {
+	drawableForm
+	err error
+}
+
+func (f submitErrorForm) drawForm() {
+	printText("\x1b[31m" + f.err.Error() + "\x1b[0m\n\n")
+	f.drawableForm.drawForm()
+}
+
+// Field is a structure containing a single form field.
+//
+// Placeholder is displayed while the field is empty. Required, Format,
+// Options and Validator constrain the input accepted when the form is
+// submitted. MaxLen limits the number of characters that can be entered, and
+// AutoSubmit moves to the next field once MaxLen characters are entered.
 type Field struct {
 	DisplayName, Input string
+	Placeholder        string
 	Mask               rune
 	Format             *regexp.Regexp
+	Required           bool
+	Options            []string
+	Validator          func(input string) error
+	MaxLen             int
+	AutoSubmit         bool
 	pos                pos
+	focused            bool
+	err                error
+}
+
+// FieldError is a validation error for a single field
+type FieldError struct {
+	Field *Field
+	Err   error
+}
+
+func (e FieldError) Error() string {
+	return e.Field.DisplayName + ": " + e.Err.Error()
+}
+
+// FieldOption sets an optional property of a Field
+type FieldOption func(f *Field)
+
+// NewField returns a new field with the given display name and options
+func NewField(displayName string, opts ...FieldOption) *Field {
+	f := &Field{DisplayName: displayName}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// WithFieldPlaceholder sets the text displayed while the field is empty
+func WithFieldPlaceholder(s string) FieldOption {
+	return func(f *Field) {
+		f.Placeholder = s
+	}
+}
+
+// WithFieldMask sets the rune displayed in place of each input character
+func WithFieldMask(r rune) FieldOption {
+	return func(f *Field) {
+		f.Mask = r
+	}
+}
+
+// WithFieldFormat sets the pattern the field input must match
+func WithFieldFormat(re *regexp.Regexp) FieldOption {
+	return func(f *Field) {
+		f.Format = re
+	}
+}
+
+// WithFieldRequired sets whether the field input may be empty
+func WithFieldRequired(required bool) FieldOption {
+	return func(f *Field) {
+		f.Required = required
+	}
+}
+
+// WithFieldOptions sets the values the field input is limited to
+func WithFieldOptions(opts []string) FieldOption {
+	return func(f *Field) {
+		f.Options = opts
+	}
+}
+
+// WithFieldValidator sets a function used to validate the field input
+func WithFieldValidator(fn func(input string) error) FieldOption {
+	return func(f *Field) {
+		f.Validator = fn
+	}
+}
+
+// SetMask sets the rune displayed in place of each input character, and
+// redraws the field if it is being edited in a displayed form, such as to
+// show or hide a password. Pass 0 to use the mask set by SetInputMaskChar.
+func (f *Field) SetMask(r rune) {
+	mu.Lock()
+	defer mu.Unlock()
+	f.Mask = r
+	if f == activeField && !closed {
+		// Redraw field input
+		clearArea(f.pos, curPos)
+		curPos = f.pos
+		drawInput(activeCursor, f.Input, f.mask(), false)
+	}
+}
+
+// mask returns the rune displayed in place of each input character, or 0 if
+// the input is shown
+func (f *Field) mask() rune {
+	if f.Mask != 0 {
+		return f.Mask
+	}
+	return inputMaskChar
+}
+
+// WithFieldMaxLen sets the maximum number of characters of the field input
+func WithFieldMaxLen(n int) FieldOption {
+	return func(f *Field) {
+		f.MaxLen = n
+	}
+}
+
+// WithFieldAutoSubmit sets whether the form moves to the next field, or is
+// submitted from the last field, once MaxLen characters are entered
+func WithFieldAutoSubmit(enabled bool) FieldOption {
+	return func(f *Field) {
+		f.AutoSubmit = enabled
+	}
 }
 
 func (f *Field) drawField(maxDNameLen int) {
-	if len(f.DisplayName) > 0 {
-		Printf("%s:%s    ", f.DisplayName, strings.Repeat(" ", maxDNameLen-len(f.DisplayName)))
+	if len(f.DisplayName) == 0 {
+		return
+	}
+
+	// Get displayed input
+	text := f.Input
+	if f.Input == "" && f.Placeholder != "" {
+		text = f.Placeholder
+	} else if mask := f.mask(); mask != 0 {
+		text = strings.Repeat(string(mask), utf8.RuneCountInString(f.Input))
+	}
+
+	switch formStyle {
+	case FormStyleStacked:
+		printText(f.DisplayName + ":\n" + strings.Repeat(" ", tabSize))
+		f.pos = curPos
+		printText(indentLines(text, f.pos.x) + "\n")
+	case FormStyleBordered:
+		// Fit box to the longest name and the longest line of input
+		nameLen := utf8.RuneCountInString(f.DisplayName)
+		lines := strings.Split(text, "\n")
+		width := maxDNameLen + 2
+		if width < nameLen+2 {
+			width = nameLen + 2
+		}
+		for _, l := range lines {
+			if n := utf8.RuneCountInString(l); n > width {
+				width = n
+			}
+		}
+		printText("┌─ " + f.DisplayName + " " + strings.Repeat("─", width-nameLen-1) + "┐\n")
+		for i, l := range lines {
+			printText("│ ")
+			if i == 0 {
+				f.pos = curPos
+			}
+			printText(l + strings.Repeat(" ", width-utf8.RuneCountInString(l)) + " │\n")
+		}
+		printText("└" + strings.Repeat("─", width+2) + "┘\n")
+	default:
+		printText(fmt.Sprintf("%s:%s    ", f.DisplayName, strings.Repeat(" ", maxDNameLen-len(f.DisplayName))))
 		f.pos = curPos
-		Println(f.Input)
+		printText(indentLines(text, f.pos.x) + "\n")
 	}
 }
 
+func (f *Field) validate() error {
+	if f.Input == "" {
+		if f.Required {
+			return ErrFieldRequired
+		}
+		return nil
+	}
+	if f.Format != nil && !f.Format.MatchString(f.Input) {
+		return ErrFieldFormat
+	}
+	if len(f.Options) > 0 {
+		valid := false
+		for _, opt := range f.Options {
+			if f.Input == opt {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return ErrFieldOption
+		}
+	}
+	if f.Validator != nil {
+		return f.Validator(f.Input)
+	}
+	return nil
+}
+
 func (f *Field) getInput(cursor int) inputEvent {
-	ev := getInput(f.pos, cursor, f.Input, f.Mask)
+	ev := getInput(f.pos, cursor, f.Input, f.mask(), false)
 	switch ev.Type {
 	case termbox.EventKey:
 		f.Input = ev.Input
@@ -40,42 +366,124 @@ func (f *Field) getInput(cursor int) inputEvent {
 // FieldList is a collection of fields
 type FieldList []*Field
 
-func (fl FieldList) getInputs(form drawableForm) bool {
+// FocusField sets which field has focus when the form is first displayed
+func (fl FieldList) FocusField(index int) error {
+	if index < 0 || index >= len(fl) {
+		return ErrInvalidFieldIndex
+	}
+	for i, f := range fl {
+		f.focused = i == index
+	}
+	return nil
+}
+
+// focusIndex returns the index of the field focused using FocusField, or of
+// the first invalid field if auto focus is enabled. The caller must hold mu,
+// which is released while validating.
+func (fl FieldList) focusIndex() int {
+	for i, f := range fl {
+		if f.focused {
+			return i
+		}
+	}
+	if fieldAutoFocus {
+		var errs []FieldError
+		unlocked(func() {
+			errs = fl.Validate()
+		})
+		if len(errs) > 0 {
+			for i, f := range fl {
+				if f == errs[0].Field {
+					return i
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func (fl FieldList) getInputs(form drawableForm, focus int) bool {
 	if len(fl) == 0 {
 		return true
 	}
 
-	var curField int
+	curField := focus
 	cursor := utf8.RuneCountInString(fl[curField].Input)
+	defer func() {
+		activeField = nil
+	}()
 
 	// Update cursor position
 	curPos = fl[curField].pos
-	if fl[curField].Mask != 0 {
-		drawText(cursor, strings.Repeat(string(fl[curField].Mask), utf8.RuneCountInString(fl[curField].Input)))
-	} else {
-		drawText(cursor, fl[curField].Input)
-	}
+	drawInput(cursor, fl[curField].Input, fl[curField].mask(), false)
 
 	for {
 		initPos := curPos
+		initInput := fl[curField].Input
+		activeField, activeCursor = fl[curField], cursor
 
 		// Get input
 		switch ev := fl[curField].getInput(cursor); ev.Type {
 		case termbox.EventKey:
+			// Reject input longer than the maximum length
+			if f := fl[curField]; f.MaxLen > 0 && utf8.RuneCountInString(f.Input) > f.MaxLen {
+				f.Input = initInput
+				ev.Cursor = cursor
+				clearArea(f.pos, curPos)
+				curPos = f.pos
+				drawInput(cursor, f.Input, f.mask(), false)
+			}
 			cursor = ev.Cursor
 
-			if curPos.y != initPos.y {
+			// Insert line break at cursor position in multi-line mode
+			changed := false
+			if fieldInputMode == FieldInputMultiLine {
+				switch ev.Key {
+				case termbox.KeyEnter:
+					pos := bytePos(cursor, fl[curField].Input)
+					fl[curField].Input = fl[curField].Input[:pos] + "\n" + fl[curField].Input[pos:]
+					cursor++
+					ev.Key = 0
+					changed = true
+				case termbox.KeyCtrlJ:
+					return true
+				}
+			}
+
+			// Let the field change hook update other fields, without
+			// blocking output from it
+			if fn := onFieldChange; fn != nil && fl[curField].Input != initInput {
+				unlocked(func() {
+					fn(fl[curField], initInput, fl[curField].Input)
+				})
+				if n := utf8.RuneCountInString(fl[curField].Input); cursor > n {
+					cursor = n
+				}
+				changed = true
+			}
+
+			// Redraw form if input wrapped to another row, if the
+			// placeholder was shown or hidden, or if a line break was
+			// inserted or the field change hook was called
+			placeholderToggled := fl[curField].Placeholder != "" && (initInput == "") != (fl[curField].Input == "")
+			if formStyle == FormStyleBordered && fl[curField].Input != initInput {
+				// Resize box around field
+				changed = true
+			}
+			if curPos.y != initPos.y || placeholderToggled || changed {
 				// Redraw form
-				termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
+				clearScreen()
+				curPos = pos{0, 0}
 				form.drawForm()
 
 				// Update cursor position
 				curPos = fl[curField].pos
-				if fl[curField].Mask != 0 {
-					drawText(cursor, strings.Repeat(string(fl[curField].Mask), utf8.RuneCountInString(fl[curField].Input)))
-				} else {
-					drawText(cursor, fl[curField].Input)
-				}
+				drawInput(cursor, fl[curField].Input, fl[curField].mask(), false)
+			}
+
+			// Move to next field once a fixed-length field is filled
+			if f := fl[curField]; (fieldAutoSubmit || f.AutoSubmit) && f.MaxLen > 0 && f.Input != initInput && utf8.RuneCountInString(f.Input) == f.MaxLen {
+				ev.Key = termbox.KeyEnter
 			}
 
 			switch ev.Key {
@@ -94,11 +502,7 @@ func (fl FieldList) getInputs(form drawableForm) bool {
 
 					// Update cursor position
 					curPos = fl[curField].pos
-					if fl[curField].Mask != 0 {
-						drawText(cursor, strings.Repeat(string(fl[curField].Mask), utf8.RuneCountInString(fl[curField].Input)))
-					} else {
-						drawText(cursor, fl[curField].Input)
-					}
+					drawInput(cursor, fl[curField].Input, fl[curField].mask(), false)
 				}
 			case termbox.KeyArrowUp:
 				if curField > 0 {
@@ -107,27 +511,21 @@ func (fl FieldList) getInputs(form drawableForm) bool {
 
 					// Update cursor position
 					curPos = fl[curField].pos
-					if fl[curField].Mask != 0 {
-						drawText(cursor, strings.Repeat(string(fl[curField].Mask), utf8.RuneCountInString(fl[curField].Input)))
-					} else {
-						drawText(cursor, fl[curField].Input)
-					}
+					drawInput(cursor, fl[curField].Input, fl[curField].mask(), false)
 				}
 			case termbox.KeyCtrlC:
 				return false
 			}
 		case termbox.EventResize:
 			// Redraw form
-			termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
+			clearScreen()
+			curPos = pos{0, 0}
 			form.drawForm()
 
 			// Update cursor position
 			curPos = fl[curField].pos
-			if fl[curField].Mask != 0 {
-				drawText(cursor, strings.Repeat(string(fl[curField].Mask), utf8.RuneCountInString(fl[curField].Input)))
-			} else {
-				drawText(cursor, fl[curField].Input)
-			}
+			drawInput(cursor, fl[curField].Input, fl[curField].mask(), false)
+			resized()
 		}
 	}
 }
@@ -143,26 +541,105 @@ func (fl FieldList) drawForm() {
 		// Render input name
 		f.drawField(maxDNameLen)
 	}
+
+	// Render validation errors
+	for _, f := range fl {
+		if f.err != nil {
+			printText(FieldError{f, f.err}.Error() + "\n")
+		}
+	}
 }
 
-// Form renders a series of input fields to be filled before returning
-func (fl FieldList) Form() bool {
-	// Draw form
-	fl.drawForm()
+// Validate checks the input of each field, and returns an error for each
+// field with invalid input
+func (fl FieldList) Validate() []FieldError {
+	var errs []FieldError
+	for _, f := range fl {
+		if err := f.validate(); err != nil {
+			errs = append(errs, FieldError{f, err})
+		}
+	}
+	return errs
+}
 
-	// Get form input
-	cancelled := !fl.getInputs(fl)
+func (fl FieldList) form(base drawableForm) bool {
+	form := base
+	focus := fl.focusIndex()
+	valid := false
+
+	for !valid {
+		// Get form input
+		if !fl.getInputs(form, focus) {
+			break
+		}
+
+		// Validate form input, without blocking output from validators
+		var errs []FieldError
+		unlocked(func() {
+			errs = fl.Validate()
+		})
+		for _, f := range fl {
+			f.err = nil
+		}
+		for _, e := range errs {
+			e.Field.err = e.Err
+		}
+		valid = len(errs) == 0
+		form = base
+
+		// Submit form input, without blocking output from the submit function
+		if fn := onFormSubmit; valid && fn != nil {
+			var err error
+			unlocked(func() {
+				err = fn(fl)
+			})
+			if err != nil {
+				form = submitErrorForm{base, err}
+				valid = false
+			}
+		}
+
+		// Focus first invalid field
+		if fieldAutoFocus && len(errs) > 0 {
+			for i, f := range fl {
+				if f == errs[0].Field {
+					focus = i
+					break
+				}
+			}
+		}
+
+		if !valid {
+			// Redraw form with validation or submit errors
+			clearScreen()
+			curPos = pos{0, 0}
+			form.drawForm()
+		}
+	}
+
+	// Reset validation errors
+	for _, f := range fl {
+		f.err = nil
+	}
 
 	// Clear terminal
-	termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
+	clearScreen()
 	curPos = pos{0, 1}
 
-	if cancelled {
-		return false
-	}
+	return valid
+}
 
-	// TODO: Validate form input
-	return true
+// Form renders a series of input fields to be filled before returning
+func (fl FieldList) Form() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	defer suspendPaging()()
+
+	// Draw form
+	fl.drawForm()
+
+	// Get form input
+	return fl.form(fl)
 }
 
 // FieldCategory is a FieldList with a title
@@ -175,21 +652,24 @@ type FieldCategory struct {
 type FieldCategoryList []*FieldCategory
 
 func (fcl FieldCategoryList) drawForm() {
-	curPos = pos{0, 0}
-
 	for _, fc := range fcl {
 		// Render category title
-		Println(fc.DisplayName)
+		printText(fc.DisplayName + "\n")
 
 		// Render category form
 		fc.Fields.drawForm()
-		Println()
+		printText("\n")
 	}
 }
 
 // Form renders a series of input fields to be filled before returning
 func (fcl FieldCategoryList) Form() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	defer suspendPaging()()
+
 	// Draw form
+	curPos = pos{0, 0}
 	fcl.drawForm()
 
 	// Get form input
@@ -199,16 +679,5 @@ func (fcl FieldCategoryList) Form() bool {
 			fields = append(fields, f)
 		}
 	}
-	cancelled := !fields.getInputs(fcl)
-
-	// Clear terminal
-	termbox.Clear(termbox.ColorWhite, termbox.ColorDefault)
-	curPos = pos{0, 1}
-
-	if cancelled {
-		return false
-	}
-
-	// TODO: Validate form input
-	return true
+	return fields.form(fcl)
 }
@@ -1,11 +1,68 @@
 package cli
 
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoHistoryFile is returned when saving history without a history file set
+var ErrNoHistoryFile = errors.New("no history file set")
+
+var historyTimestamps bool
+var historyFile string
+var autoSaveInterval time.Duration
+var autoSaveStop chan struct{}
+var onHistoryChange func(entries []string)
+var maxHistoryFileSize int64
+var historyKeepEntries int
+var historyDedup bool
+var searchBackend func(query string, entries []string) []int
+var searchNormalize = strings.TrimSpace
+var historyWriteMode = HistoryWriteAppend
+
+// HistoryWriteMode is a mode of writing the history file, set by
+// SetHistoryWriteMode
+type HistoryWriteMode int
+
+// History write modes
+const (
+	// HistoryWriteAppend appends each new entry to the history file when it
+	// is entered, and SaveHistory appends only entries not yet written
+	// (default)
+	HistoryWriteAppend HistoryWriteMode = iota
+	// HistoryWriteRewrite writes the whole history to the history file each
+	// time SaveHistory is called, and nothing in between
+	HistoryWriteRewrite
+)
+
+// SetHistoryWriteMode sets how the CLI input history is written to the file
+// set by SetHistoryFile
+func SetHistoryWriteMode(mode HistoryWriteMode) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	historyWriteMode = mode
+}
+
 type line struct {
 	original, edited string
-	isEdited         bool
+	isEdited, saved  bool
+	timestamp        time.Time
+}
+
+func (l *line) touch() {
+	if historyTimestamps {
+		l.timestamp = time.Now()
+	}
 }
 
 type history struct {
+	mu      sync.Mutex
 	entries []*line
 	index   int
 }
@@ -59,8 +116,19 @@ func (h *history) new() {
 	if h.get() == "" {
 		return
 	}
+	if historyDedup && h.index > 0 && h.entries[h.index-1].original == h.get() {
+		// Reuse duplicate entry for new input
+		h.entries[h.index] = &line{}
+		return
+	}
+	if historyFile != "" && historyWriteMode == HistoryWriteAppend {
+		if appendHistoryFile(historyFile, h.entries[h.index:h.index+1]) == nil {
+			rotateHistoryFile(historyFile)
+		}
+	}
 	h.index++
 	h.entries = append(h.entries, &line{})
+	h.changed()
 }
 
 func (h *history) get() string {
@@ -76,10 +144,14 @@ func (h *history) get() string {
 func (h *history) set(s string) {
 	// If last history entry, store changes in original, otherwise store in edited
 	if h.isNew() {
-		h.entries = append(h.entries, &line{original: s})
+		l := &line{original: s}
+		l.touch()
+		h.entries = append(h.entries, l)
+		h.changed()
 		return
 	} else if h.isLast() {
 		h.entries[h.index].original = s
+		h.entries[h.index].touch()
 	} else if s == h.entries[h.index].original {
 		h.entries[h.index].isEdited = false
 	} else {
@@ -101,5 +173,406 @@ func (h *history) revertAndAdd() {
 		return
 	}
 	h.entries[len(h.entries)-1] = &line{original: h.entries[h.index].edited}
+	h.entries[len(h.entries)-1].touch()
 	h.revert()
 }
+
+func (h *history) originals() []string {
+	var entries []string
+	for _, l := range h.entries {
+		if l.original != "" {
+			entries = append(entries, l.original)
+		}
+	}
+	return entries
+}
+
+func (h *history) changed() {
+	if fn := onHistoryChange; fn != nil {
+		go fn(h.originals())
+	}
+}
+
+// SetOnHistoryChange sets a function to be called in a new goroutine
+// whenever an entry is added to the CLI input history. The function receives
+// a copy of the original contents of all history entries.
+func SetOnHistoryChange(fn func(entries []string)) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	onHistoryChange = fn
+}
+
+// ClearOnHistoryChange removes the function set by SetOnHistoryChange
+func ClearOnHistoryChange() {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	onHistoryChange = nil
+}
+
+// SetHistoryDedup sets whether input identical to the previous CLI input
+// history entry is left out of the history. Takes effect from the next
+// entered input, and may be changed while a CLI is running.
+func SetHistoryDedup(enabled bool) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	historyDedup = enabled
+}
+
+// scratch moves to the last history entry, adding an empty entry to edit if
+// the last entry is not empty
+func (h *history) scratch() {
+	if len(h.entries) == 0 {
+		h.index = 0
+		return
+	}
+	h.index = len(h.entries) - 1
+	if h.entries[h.index].original != "" {
+		h.entries = append(h.entries, &line{})
+		h.index++
+	}
+}
+
+// SetInputHistory replaces the CLI input history with the given entries
+func SetInputHistory(entries []string) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+
+	hist.entries = nil
+	for _, s := range entries {
+		hist.entries = append(hist.entries, &line{original: s})
+	}
+	hist.scratch()
+}
+
+// HistoryEntry is a single CLI input history entry with the time it was entered
+type HistoryEntry struct {
+	Line string
+	Time time.Time
+}
+
+// SetHistoryTimestamps sets whether the time each CLI input history entry
+// was entered should be recorded
+func SetHistoryTimestamps(enabled bool) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	historyTimestamps = enabled
+}
+
+// GetHistoryWithTimestamps returns all CLI input history entries along with
+// the time they were entered. The time is zero if timestamps were not enabled
+// when the entry was entered.
+func GetHistoryWithTimestamps() []HistoryEntry {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+
+	var entries []HistoryEntry
+	for _, l := range hist.entries {
+		if l.original != "" {
+			entries = append(entries, HistoryEntry{Line: l.original, Time: l.timestamp})
+		}
+	}
+	return entries
+}
+
+// ExportHistory returns the original contents of all CLI input history entries
+func ExportHistory() []string {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+
+	return hist.originals()
+}
+
+func formatHistoryLine(l *line) string {
+	s := l.original + "\n"
+	if !l.timestamp.IsZero() {
+		s = "#" + l.timestamp.UTC().Format(time.RFC3339) + "\n" + s
+	}
+	return s
+}
+
+func readHistoryFile(path string) ([]*line, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*line
+	var timestamp time.Time
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if strings.HasPrefix(text, "#") {
+			if t, err := time.Parse(time.RFC3339, text[1:]); err == nil {
+				timestamp = t
+				continue
+			}
+		}
+		if text == "" {
+			continue
+		}
+		entries = append(entries, &line{original: text, timestamp: timestamp, saved: true})
+		timestamp = time.Time{}
+	}
+	return entries, scanner.Err()
+}
+
+// appendHistoryFile appends the entries not yet written to the history file,
+// and marks them as written
+func appendHistoryFile(path string, entries []*line) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, l := range entries {
+		if l.original != "" && !l.saved {
+			w.WriteString(formatHistoryLine(l))
+		}
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		markSaved(entries)
+	}
+	return err
+}
+
+// markSaved marks non-empty entries as written to the history file
+func markSaved(entries []*line) {
+	for _, l := range entries {
+		if l.original != "" {
+			l.saved = true
+		}
+	}
+}
+
+// SetHistoryFile loads the CLI input history stored in the file at path, and
+// writes new history entries to the file from then on, as set by
+// SetHistoryWriteMode. Loaded entries are
+// inserted before the current history, unless overwrite is true, in which
+// case they replace it.
+func SetHistoryFile(path string, overwrite bool) error {
+	entries, err := readHistoryFile(path)
+	if err != nil {
+		return err
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+
+	if overwrite {
+		if closed {
+			hist.entries = entries
+		} else {
+			// Keep the entry currently being executed
+			hist.entries = append(entries, &line{original: hist.get()})
+		}
+		hist.index = len(hist.entries) - 1
+	} else {
+		hist.entries = append(entries, hist.entries...)
+		hist.index += len(entries)
+	}
+	if closed {
+		hist.scratch()
+	}
+
+	historyFile = path
+	return nil
+}
+
+// UnsetHistoryFile stops appending new CLI input history entries to the file
+// set by SetHistoryFile. The current history is kept.
+func UnsetHistoryFile() {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	historyFile = ""
+}
+
+// SaveHistory writes the CLI input history to the file set by
+// SetHistoryFile. In HistoryWriteRewrite mode, the whole history replaces the
+// contents of the file. In HistoryWriteAppend mode, only entries not yet
+// written are appended to it.
+func SaveHistory() error {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+
+	if historyFile == "" {
+		return ErrNoHistoryFile
+	}
+	var err error
+	if historyWriteMode == HistoryWriteAppend {
+		err = appendHistoryFile(historyFile, hist.entries)
+	} else {
+		if err = writeHistoryFile(historyFile, hist.entries); err == nil {
+			markSaved(hist.entries)
+		}
+	}
+	if err == nil {
+		err = rotateHistoryFile(historyFile)
+	}
+	return err
+}
+
+func writeHistoryFile(path string, entries []*line) error {
+	// Write to a temporary file first, so the history file is replaced atomically
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, l := range entries {
+		if l.original != "" {
+			w.WriteString(formatHistoryLine(l))
+		}
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// SetMaxHistoryFileSize sets the maximum size in bytes of the file set by
+// SetHistoryFile. When the file grows larger, it is rewritten with only the
+// most recent entries that fit. Pass 0 to disable the limit.
+func SetMaxHistoryFileSize(bytes int64) {
+	SetHistoryFileRotation(bytes, 0)
+}
+
+// SetHistoryFileRotation sets the maximum size in bytes of the file set by
+// SetHistoryFile. When the file grows larger, it is rewritten with at most
+// the keepEntries most recent entries, dropping more entries if needed until
+// it fits. If keepEntries is 0, only as many entries are dropped as needed.
+func SetHistoryFileRotation(maxBytes int64, keepEntries int) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	maxHistoryFileSize = maxBytes
+	historyKeepEntries = keepEntries
+}
+
+// rotateHistoryFile rewrites the history file with only its most recent
+// entries if it is larger than the maximum history file size
+func rotateHistoryFile(path string) error {
+	if maxHistoryFileSize <= 0 {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() <= maxHistoryFileSize {
+		return err
+	}
+
+	entries, err := readHistoryFile(path)
+	if err != nil {
+		return err
+	}
+	if historyKeepEntries > 0 && len(entries) > historyKeepEntries {
+		entries = entries[len(entries)-historyKeepEntries:]
+	}
+
+	// Drop oldest entries until the file fits
+	var size int64
+	for _, l := range entries {
+		size += int64(len(formatHistoryLine(l)))
+	}
+	for len(entries) > 0 && size > maxHistoryFileSize {
+		size -= int64(len(formatHistoryLine(entries[0])))
+		entries = entries[1:]
+	}
+
+	return writeHistoryFile(path, entries)
+}
+
+// SetSearchBackend sets the function used to search the CLI input history
+// when Ctrl+R is pressed. The function receives the search query and all
+// history entries, oldest first, and returns the indices of matching entries
+// in order of preference. Pass nil to use the default search, which matches
+// entries containing the query regardless of case, most recent first.
+func SetSearchBackend(fn func(query string, entries []string) []int) {
+	mu.Lock()
+	defer mu.Unlock()
+	searchBackend = fn
+}
+
+// SetInputNormalizationFunc sets a function used to normalize both the
+// search query and the CLI input history entries when searching the history,
+// such as by lowercasing them or collapsing whitespace. Entries are displayed
+// and executed as entered. Pass nil to use strings.TrimSpace (default).
+func SetInputNormalizationFunc(fn func(input string) string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if fn == nil {
+		fn = strings.TrimSpace
+	}
+	searchNormalize = fn
+}
+
+// searchEntries returns the indices of history entries containing query
+// regardless of case, most recent first
+func searchEntries(query string, entries []string) []int {
+	if query == "" {
+		return nil
+	}
+	query = strings.ToLower(query)
+	var matches []int
+	for i := len(entries) - 1; i >= 0; i-- {
+		if strings.Contains(strings.ToLower(entries[i]), query) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// SetAutoSaveInterval sets how often the CLI input history is saved using
+// SaveHistory while a CLI is running. Pass 0 to disable auto-saving.
+func SetAutoSaveInterval(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	stopAutoSave()
+	autoSaveInterval = d
+	if !closed {
+		startAutoSave()
+	}
+}
+
+func startAutoSave() {
+	if autoSaveInterval <= 0 || autoSaveStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	autoSaveStop = stop
+	go func(d time.Duration) {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				SaveHistory()
+			case <-stop:
+				return
+			}
+		}
+	}(autoSaveInterval)
+}
+
+func stopAutoSave() {
+	if autoSaveStop != nil {
+		close(autoSaveStop)
+		autoSaveStop = nil
+	}
+}